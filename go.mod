@@ -0,0 +1,5 @@
+module github.com/cs8425/go-smalltools
+
+go 1.22
+
+require golang.org/x/crypto v0.31.0
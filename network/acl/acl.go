@@ -0,0 +1,318 @@
+// Package acl is the destination access rules of the proxies.
+//
+// One rule per line, '#' start a comment, missing fields are '*':
+//
+//	action  dest  [ports  [users]]
+//
+//	action: allow, deny, or log (log the match and go on)
+//	dest:   IP, CIDR, domain, '.example.com' (domain and subdomains),
+//	        wildcard like '*.example.com' or 'api-?.example.com', '*' for any
+//	ports:  '80', '8000-8999', list by ',', '*' for any
+//	users:  authenticated user names by ',', '-' for no user, '*' for any
+//
+// The first matched allow or deny rule decide, allow if none matched.
+// IP and CIDR match the address really connected, so a domain resolved to a denied address is denied too,
+// domain rules match the name asked by client.
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrDenied is permanent, dialer not retry it
+var ErrDenied error = deniedError{}
+
+type deniedError struct{}
+
+func (deniedError) Error() string   { return "acl: denied" }
+func (deniedError) Permanent() bool { return true }
+
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+	Log
+)
+
+var actionName = map[string]Action{"allow": Allow, "deny": Deny, "log": Log}
+
+func (a Action) String() string {
+	for k, v := range actionName {
+		if v == a {
+			return k
+		}
+	}
+	return "action(" + strconv.Itoa(int(a)) + ")"
+}
+
+// Dest is the destination to check
+type Dest struct {
+	Host string // domain name asked by client, empty if client asked an IP
+	IP   net.IP // nil if not resolved yet
+	Port int
+	User string // authenticated user, empty if none
+}
+
+func (d Dest) String() string {
+	s := d.Host
+	if d.IP != nil {
+		if s != "" {
+			s += "|"
+		}
+		s += d.IP.String()
+	}
+	s = net.JoinHostPort(s, strconv.Itoa(d.Port))
+	if d.User != "" {
+		s = d.User + " -> " + s
+	}
+	return s
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+type Rule struct {
+	Line   int
+	Action Action
+	Text   string
+
+	any     bool       // dest '*'
+	nets    *net.IPNet // dest IP or CIDR
+	domain  string     // exact or '.suffix'
+	pattern string     // wildcard
+	ports   []portRange
+	users   []string // nil = any
+}
+
+func (r *Rule) String() string {
+	return fmt.Sprintf("line %v: %v", r.Line, r.Text)
+}
+
+func (r *Rule) match(d *Dest) bool {
+	if !r.matchDest(d) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		ok := false
+		for _, p := range r.ports {
+			if d.Port >= p.lo && d.Port <= p.hi {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.users != nil {
+		user := d.User
+		if user == "" {
+			user = "-"
+		}
+		for _, u := range r.users {
+			if u == user {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r *Rule) matchDest(d *Dest) bool {
+	switch {
+	case r.any:
+		return true
+	case r.nets != nil:
+		return d.IP != nil && r.nets.Contains(d.IP)
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(d.Host, "."))
+	if host == "" {
+		return false
+	}
+	if r.pattern != "" {
+		ok, _ := path.Match(r.pattern, host)
+		return ok
+	}
+	if strings.HasPrefix(r.domain, ".") {
+		return host == r.domain[1:] || strings.HasSuffix(host, r.domain)
+	}
+	return host == r.domain
+}
+
+// List is a loaded rule file, safe for concurrent use
+type List struct {
+	File string
+
+	// Log is called for matched log rule
+	Log func(r *Rule, d Dest)
+
+	lock  sync.RWMutex
+	rules []*Rule
+}
+
+// Load read the rule file
+func Load(fp string) (*List, error) {
+	l := &List{File: fp}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload read the file again, keep the old rules on error
+func (l *List) Reload() error {
+	f, err := os.Open(l.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rules []*Rule
+	sc := bufio.NewScanner(f)
+	for i := 1; sc.Scan(); i++ {
+		line := sc.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		r, err := ParseRule(fields)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", l.File, i, err)
+		}
+		r.Line = i
+		rules = append(rules, r)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	l.rules = rules
+	l.lock.Unlock()
+	return nil
+}
+
+// Len return count of rules
+func (l *List) Len() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return len(l.rules)
+}
+
+// Check return false and the deny rule if d is denied, the rule is nil if no rule matched
+func (l *List) Check(d Dest) (bool, *Rule) {
+	l.lock.RLock()
+	rules := l.rules
+	l.lock.RUnlock()
+
+	for _, r := range rules {
+		if !r.match(&d) {
+			continue
+		}
+		switch r.Action {
+		case Log:
+			if l.Log != nil {
+				l.Log(r, d)
+			}
+		case Deny:
+			return false, r
+		default:
+			return true, r
+		}
+	}
+	return true, nil
+}
+
+// ParseRule parse fields of a rule line: action dest [ports [users]]
+func ParseRule(fields []string) (*Rule, error) {
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, errors.New("want: action dest [ports [users]]")
+	}
+	for len(fields) < 4 {
+		fields = append(fields, "*")
+	}
+
+	act, ok := actionName[strings.ToLower(fields[0])]
+	if !ok {
+		return nil, errors.New("unknown action " + fields[0])
+	}
+	r := &Rule{Action: act, Text: strings.Join(fields, " ")}
+	if err := r.parseDest(fields[1]); err != nil {
+		return nil, err
+	}
+	if err := r.parsePorts(fields[2]); err != nil {
+		return nil, err
+	}
+	if fields[3] != "*" {
+		r.users = strings.Split(fields[3], ",")
+	}
+	return r, nil
+}
+
+func (r *Rule) parseDest(s string) error {
+	if s == "*" {
+		r.any = true
+		return nil
+	}
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		r.nets = ipnet
+		return nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.nets = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if strings.ContainsAny(s, "*?[") {
+		if _, err := path.Match(s, ""); err != nil {
+			return fmt.Errorf("bad wildcard %v: %v", s, err)
+		}
+		r.pattern = s
+		return nil
+	}
+	r.domain = s
+	return nil
+}
+
+func (r *Rule) parsePorts(s string) error {
+	if s == "*" {
+		return nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		lo, hi := part, part
+		if idx := strings.IndexByte(part, '-'); idx >= 0 {
+			lo, hi = part[:idx], part[idx+1:]
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l < 0 || h > 0xffff || l > h {
+			return errors.New("bad port " + part)
+		}
+		r.ports = append(r.ports, portRange{l, h})
+	}
+	return nil
+}
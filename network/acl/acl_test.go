@@ -0,0 +1,200 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, rules string) *List {
+	fp := filepath.Join(t.TempDir(), "acl.txt")
+	if err := os.WriteFile(fp, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Load(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func dest(host string, port int, user string) Dest {
+	d := Dest{Port: port, User: user}
+	if ip := net.ParseIP(host); ip != nil {
+		d.IP = ip
+	} else {
+		d.Host = host
+	}
+	return d
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		rule string
+		dest Dest
+		want bool
+	}{
+		// IP and CIDR
+		{"deny 10.0.0.0/8", dest("10.1.2.3", 80, ""), true},
+		{"deny 10.0.0.0/8", dest("11.1.2.3", 80, ""), false},
+		{"deny 10.0.0.0/8", dest("example.com", 80, ""), false},
+		{"deny 10.0.0.0/8", Dest{Host: "intra.example.com", IP: net.ParseIP("10.0.0.1"), Port: 80}, true},
+		{"deny 192.168.1.1", dest("192.168.1.1", 80, ""), true},
+		{"deny 192.168.1.1", dest("192.168.1.2", 80, ""), false},
+		{"deny 192.168.1.1", dest("::ffff:192.168.1.1", 80, ""), true},
+		{"deny fd00::/8", dest("fd12::1", 80, ""), true},
+		{"deny fd00::/8", dest("fe80::1", 80, ""), false},
+		{"deny ::1", dest("::1", 80, ""), true},
+		{"deny ::1", dest("127.0.0.1", 80, ""), false},
+
+		// domain
+		{"deny example.com", dest("example.com", 80, ""), true},
+		{"deny example.com", dest("EXAMPLE.com.", 80, ""), true},
+		{"deny example.com", dest("www.example.com", 80, ""), false},
+		{"deny .example.com", dest("example.com", 80, ""), true},
+		{"deny .example.com", dest("a.b.example.com", 80, ""), true},
+		{"deny .example.com", dest("badexample.com", 80, ""), false},
+		{"deny .example.com", dest("93.184.216.34", 80, ""), false},
+
+		// wildcard
+		{"deny *.example.com", dest("www.example.com", 80, ""), true},
+		{"deny *.example.com", dest("example.com", 80, ""), false},
+		{"deny *.example.com", dest("a.b.example.com", 80, ""), true}, // * cross dots
+		{"deny api-?.example.com", dest("api-1.example.com", 80, ""), true},
+		{"deny api-?.example.com", dest("api-12.example.com", 80, ""), false},
+		{"deny *", dest("1.2.3.4", 1, ""), true},
+		{"deny *", dest("anything", 1, ""), true},
+
+		// ports
+		{"deny * 25", dest("mail", 25, ""), true},
+		{"deny * 25", dest("mail", 26, ""), false},
+		{"deny * 8000-8999", dest("x", 8000, ""), true},
+		{"deny * 8000-8999", dest("x", 8999, ""), true},
+		{"deny * 8000-8999", dest("x", 9000, ""), false},
+		{"deny * 22,25,6000-6100", dest("x", 6050, ""), true},
+		{"deny * 22,25,6000-6100", dest("x", 23, ""), false},
+		{"deny * *", dest("x", 65535, ""), true},
+
+		// users
+		{"deny * * alice", dest("x", 80, "alice"), true},
+		{"deny * * alice", dest("x", 80, "bob"), false},
+		{"deny * * alice", dest("x", 80, ""), false},
+		{"deny * * alice,bob", dest("x", 80, "bob"), true},
+		{"deny * * -", dest("x", 80, ""), true},
+		{"deny * * -", dest("x", 80, "alice"), false},
+		{"deny * * *", dest("x", 80, ""), true},
+
+		// all fields
+		{"deny .example.com 443 alice", dest("www.example.com", 443, "alice"), true},
+		{"deny .example.com 443 alice", dest("www.example.com", 80, "alice"), false},
+		{"deny .example.com 443 alice", dest("www.example.org", 443, "alice"), false},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(strings.Fields(tt.rule))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.rule, err)
+		}
+		if got := r.match(&tt.dest); got != tt.want {
+			t.Errorf("%v: match %v = %v, want %v", tt.rule, tt.dest, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l := load(t, `
+# internal network only for admin
+allow 10.0.0.0/8 * admin
+deny  10.0.0.0/8
+log   .example.com   # go on
+deny  .example.com 25
+allow * 1-1023
+deny  * * guest
+`)
+	if l.Len() != 6 {
+		t.Fatalf("loaded %v rules", l.Len())
+	}
+	var logged []string
+	l.Log = func(r *Rule, d Dest) {
+		logged = append(logged, fmt.Sprintf("%v %v", r.Line, d))
+	}
+
+	tests := []struct {
+		dest Dest
+		ok   bool
+		line int // 0 = no rule matched
+	}{
+		{dest("10.0.0.1", 22, "admin"), true, 3},
+		{dest("10.0.0.1", 22, "alice"), false, 4},
+		{dest("10.0.0.1", 22, ""), false, 4},
+		{dest("mail.example.com", 25, ""), false, 6},
+		{dest("www.example.com", 443, "guest"), true, 7},
+		{dest("www.example.com", 8080, "guest"), false, 8},
+		{dest("www.example.com", 8080, "alice"), true, 0},
+	}
+	for _, tt := range tests {
+		ok, r := l.Check(tt.dest)
+		line := 0
+		if r != nil {
+			line = r.Line
+		}
+		if ok != tt.ok || line != tt.line {
+			t.Errorf("%v: got %v by line %v, want %v by line %v", tt.dest, ok, line, tt.ok, tt.line)
+		}
+	}
+	if len(logged) != 4 || !strings.HasPrefix(logged[0], "5 ") {
+		t.Errorf("logged %q", logged)
+	}
+
+	// default allow
+	ok, r := load(t, "# nothing\n").Check(dest("10.0.0.1", 22, ""))
+	if !ok || r != nil {
+		t.Errorf("empty list: %v %v", ok, r)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	bad := []string{
+		"deny",
+		"deny * * * extra",
+		"block *",
+		"deny 10.0.0.0/33",
+		"deny 10.0.0.1/x",
+		"deny [a-.example.com",
+		"deny * http",
+		"deny * 0-65536",
+		"deny * 90-80",
+		"deny * 80,",
+		"deny * -1",
+	}
+	for _, s := range bad {
+		if _, err := ParseRule(strings.Fields(s)); err == nil {
+			t.Errorf("%v: no error", s)
+		}
+	}
+
+	// line number in error, old rules kept
+	l := load(t, "deny 10.0.0.0/8\n")
+	os.WriteFile(l.File, []byte("allow *\ndeny * x\n"), 0600)
+	err := l.Reload()
+	if err == nil || !strings.Contains(err.Error(), ":2: ") {
+		t.Fatalf("reload err = %v", err)
+	}
+	if ok, _ := l.Check(dest("10.0.0.1", 80, "")); ok {
+		t.Errorf("old rules not kept after bad reload")
+	}
+}
+
+func TestErrDenied(t *testing.T) {
+	err := &net.OpError{Op: "dial", Err: fmt.Errorf("%w by %v", ErrDenied, "line 1")}
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("wrapped %v not ErrDenied", err)
+	}
+	var p interface{ Permanent() bool }
+	if !errors.As(err, &p) || !p.Permanent() {
+		t.Fatalf("%v not permanent", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Package admin is a small JSON HTTP API to list and control live tunnels.
+//
+//	GET  /tunnels                          list active tunnels
+//	POST /tunnels/kill?id=N                close a tunnel
+//	POST /limit?id=N&rx=B&tx=B             change rate limit of a tunnel
+//	POST /limit?rule=NAME&rx=B&tx=B        change rate limit of a rule and all its tunnels
+//	GET  /rules                            list rules
+//	POST /rules/enable?name=NAME           accept new connection for the rule
+//	POST /rules/disable?name=NAME          refuse new connection for the rule
+//
+// Every request need 'Authorization: Bearer TOKEN' header or 'token' parameter.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is the proxied client connection, usually a speed limited wrapper
+type Conn interface {
+	Stat() (rx int64, tx int64)
+	SetRxSpd(spd int)
+	SetTxSpd(spd int)
+	Close() error
+}
+
+// Rule is a forwarding rule can be switched at runtime
+type Rule interface {
+	Enabled() bool
+	SetEnabled(on bool)
+	SetLimit(rx int, tx int)
+	Limit() (rx int, tx int)
+}
+
+type Tunnel struct {
+	ID     uint64
+	Rule   string
+	Client string
+	Target string
+	Start  time.Time
+
+	conn Conn
+}
+
+type tunnelInfo struct {
+	ID     uint64    `json:"id"`
+	Rule   string    `json:"rule"`
+	Client string    `json:"client"`
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+	Rx     int64     `json:"rx"` // bytes client -> us
+	Tx     int64     `json:"tx"` // bytes us -> client
+}
+
+type ruleInfo struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Rx      int    `json:"rx"`
+	Tx      int    `json:"tx"`
+	Tunnels int    `json:"tunnels"`
+}
+
+type Server struct {
+	Token string
+
+	nextID  uint64
+	lock    sync.Mutex
+	tunnels map[uint64]*Tunnel
+	rules   map[string]Rule
+}
+
+func NewServer(token string) *Server {
+	return &Server{
+		Token:   token,
+		tunnels: make(map[uint64]*Tunnel),
+		rules:   make(map[string]Rule),
+	}
+}
+
+func (s *Server) AddRule(name string, r Rule) {
+	s.lock.Lock()
+	s.rules[name] = r
+	s.lock.Unlock()
+}
+
+// Add register a tunnel, call Remove when it end
+func (s *Server) Add(rule string, client string, target string, c Conn) *Tunnel {
+	t := &Tunnel{
+		ID:     atomic.AddUint64(&s.nextID, 1),
+		Rule:   rule,
+		Client: client,
+		Target: target,
+		Start:  time.Now(),
+		conn:   c,
+	}
+	s.lock.Lock()
+	s.tunnels[t.ID] = t
+	s.lock.Unlock()
+	return t
+}
+
+func (s *Server) Remove(t *Tunnel) {
+	s.lock.Lock()
+	delete(s.tunnels, t.ID)
+	s.lock.Unlock()
+}
+
+func (s *Server) ListenAndServe(addr string) {
+	log.Printf("[admin] Listen on: %v", addr)
+	err := http.ListenAndServe(addr, s)
+	if err != nil {
+		log.Printf("[admin] ListenAndServe error: %v", err)
+	}
+}
+
+func (s *Server) auth(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if hdr := r.Header.Get("Authorization"); strings.HasPrefix(hdr, "Bearer ") {
+		token = hdr[len("Bearer "):]
+	}
+	if s.Token == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.auth(r) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/tunnels":
+		writeJSON(w, s.listTunnels())
+		return
+	case "/rules":
+		writeJSON(w, s.listRules())
+		return
+	}
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/tunnels/kill":
+		t := s.getTunnel(q.Get("id"))
+		if t == nil {
+			writeError(w, http.StatusNotFound, "tunnel not found")
+			return
+		}
+		t.conn.Close()
+		writeJSON(w, map[string]interface{}{"killed": t.ID})
+
+	case "/limit":
+		s.setLimit(w, r)
+
+	case "/rules/enable", "/rules/disable":
+		name := q.Get("name")
+		s.lock.Lock()
+		rule, ok := s.rules[name]
+		s.lock.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "rule not found")
+			return
+		}
+		rule.SetEnabled(r.URL.Path == "/rules/enable")
+		writeJSON(w, map[string]interface{}{"name": name, "enabled": rule.Enabled()})
+
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) getTunnel(idStr string) *Tunnel {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tunnels[id]
+}
+
+func (s *Server) setLimit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rx, err1 := strconv.Atoi(q.Get("rx"))
+	tx, err2 := strconv.Atoi(q.Get("tx"))
+	if err1 != nil || err2 != nil {
+		writeError(w, http.StatusBadRequest, "need rx and tx (byte/sec, 0 = no limit)")
+		return
+	}
+
+	if q.Get("id") != "" {
+		t := s.getTunnel(q.Get("id"))
+		if t == nil {
+			writeError(w, http.StatusNotFound, "tunnel not found")
+			return
+		}
+		t.conn.SetRxSpd(rx)
+		t.conn.SetTxSpd(tx)
+		writeJSON(w, map[string]interface{}{"id": t.ID, "rx": rx, "tx": tx})
+		return
+	}
+
+	name := q.Get("rule")
+	s.lock.Lock()
+	rule, ok := s.rules[name]
+	var list []*Tunnel
+	for _, t := range s.tunnels {
+		if t.Rule == name {
+			list = append(list, t)
+		}
+	}
+	s.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	rule.SetLimit(rx, tx)
+	for _, t := range list {
+		t.conn.SetRxSpd(rx)
+		t.conn.SetTxSpd(tx)
+	}
+	writeJSON(w, map[string]interface{}{"rule": name, "rx": rx, "tx": tx, "tunnels": len(list)})
+}
+
+func (s *Server) listTunnels() []tunnelInfo {
+	s.lock.Lock()
+	out := make([]tunnelInfo, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		rx, tx := t.conn.Stat()
+		out = append(out, tunnelInfo{
+			ID:     t.ID,
+			Rule:   t.Rule,
+			Client: t.Client,
+			Target: t.Target,
+			Start:  t.Start,
+			Rx:     rx,
+			Tx:     tx,
+		})
+	}
+	s.lock.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (s *Server) listRules() []ruleInfo {
+	s.lock.Lock()
+	count := make(map[string]int)
+	for _, t := range s.tunnels {
+		count[t.Rule]++
+	}
+	out := make([]ruleInfo, 0, len(s.rules))
+	for name, r := range s.rules {
+		rx, tx := r.Limit()
+		out = append(out, ruleInfo{
+			Name:    name,
+			Enabled: r.Enabled(),
+			Rx:      rx,
+			Tx:      tx,
+			Tunnels: count[name],
+		})
+	}
+	s.lock.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
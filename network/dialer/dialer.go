@@ -0,0 +1,243 @@
+// Package dialer is the shared outgoing dialer of the forwarding tools:
+// connect timeout, retry with backoff, cached DNS and happy eyeballs (RFC 8305).
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// Dialer embed net.Dialer, so Timeout (per attempt), LocalAddr, Control, KeepAlive work as usual.
+// FallbackDelay is the wait before racing the next address, negative = one by one.
+type Dialer struct {
+	net.Dialer
+
+	Retries    int           // extra attempts after the first one failed
+	Backoff    time.Duration // wait before first retry, doubled every retry
+	MaxBackoff time.Duration // 0 = no limit
+
+	Resolver *Resolver // nil = no cache
+}
+
+// New return a dialer with common settings of the tools' flags
+func New(timeout time.Duration, retries int, dnsTTL time.Duration) *Dialer {
+	d := &Dialer{
+		Retries:    retries,
+		Backoff:    200 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}
+	d.Timeout = timeout
+	if dnsTTL > 0 {
+		negTTL := 5 * time.Second
+		if negTTL > dnsTTL {
+			negTTL = dnsTTL
+		}
+		d.Resolver = NewResolver(dnsTTL, negTTL)
+	}
+	return d
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext retry the whole dial until success, Retries used up or ctx done
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	backoff := d.Backoff
+	for i := 0; ; i++ {
+		conn, err := d.dialOnce(ctx, network, address)
+		if err == nil || i >= d.Retries || permanent(err) {
+			return conn, err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		backoff *= 2
+		if d.MaxBackoff > 0 && backoff > d.MaxBackoff {
+			backoff = d.MaxBackoff
+		}
+	}
+}
+
+// permanent report error that retry can not fix: name not found,
+// or error with `Permanent() bool` like denied by Control
+func permanent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return true
+	}
+	var p interface{ Permanent() bool }
+	return errors.As(err, &p) && p.Permanent()
+}
+
+func (d *Dialer) dialOnce(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	// lookup bound by Timeout too, every address still get its own Timeout
+	lctx := ctx
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		lctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ips, err := d.LookupIP(lctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = filter(network, ips)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+
+	// no handshake to race for UDP
+	if strings.HasPrefix(network, "udp") {
+		return d.Dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	return d.race(ctx, network, interleave(ips), port)
+}
+
+// LookupIP resolve host by the cache if any, for callers not dialing like UDP relay
+func (d *Dialer) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if d.Resolver != nil {
+		return d.Resolver.LookupIP(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race start next address after FallbackDelay or when the last one failed, first connected win
+func (d *Dialer) race(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.Dialer.DialContext(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var t *time.Timer
+		var fallback <-chan time.Time
+		if next < len(ips) && delay > 0 {
+			t = time.NewTimer(delay)
+			fallback = t.C
+		}
+
+		select {
+		case r := <-results:
+			if t != nil {
+				t.Stop()
+			}
+			pending--
+			if r.err == nil {
+				// close the late winners
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// filter keep addresses of the family asked by network
+func filter(network string, ips []net.IP) []net.IP {
+	want4 := strings.HasSuffix(network, "4")
+	want6 := strings.HasSuffix(network, "6")
+	if !want4 && !want6 {
+		return ips
+	}
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == want4 {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// interleave address families, start with the family of the first address
+func interleave(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	first4 := ips[0].To4() != nil
+	var primary, fallback []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == first4 {
+			primary = append(primary, ip)
+		} else {
+			fallback = append(fallback, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for len(primary) > 0 || len(fallback) > 0 {
+		if len(primary) > 0 {
+			out = append(out, primary[0])
+			primary = primary[1:]
+		}
+		if len(fallback) > 0 {
+			out = append(out, fallback[0])
+			fallback = fallback[1:]
+		}
+	}
+	return out
+}
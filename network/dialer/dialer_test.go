@@ -0,0 +1,172 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type permanentError struct{}
+
+func (permanentError) Error() string   { return "denied" }
+func (permanentError) Permanent() bool { return true }
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		tries int
+	}{
+		{"temporary", errors.New("try again"), 3},
+		{"permanent", permanentError{}, 1},
+		{"wrapped permanent", fmt.Errorf("%w by rule", permanentError{}), 1},
+	}
+	for _, tt := range tests {
+		d := New(time.Second, 2, 0)
+		d.Backoff = time.Millisecond
+		tries := 0
+		d.Control = func(network string, address string, c syscall.RawConn) error {
+			tries++
+			return tt.err
+		}
+		_, err := d.Dial("tcp", "127.0.0.1:1")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+		if tries != tt.tries {
+			t.Errorf("%v: tried %v times, want %v", tt.name, tries, tt.tries)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"name not found", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, true},
+		{"DNS timeout", &net.DNSError{Err: "i/o timeout", Name: "x", IsTimeout: true}, false},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+		{"denied", &net.OpError{Op: "dial", Err: permanentError{}}, true},
+	}
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("%v: permanent = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func ipList(s string) []net.IP {
+	var out []net.IP
+	for _, v := range strings.Fields(s) {
+		out = append(out, net.ParseIP(v))
+	}
+	return out
+}
+
+func TestInterleave(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"1.1.1.1", "1.1.1.1"},
+		{"1.1.1.1 2.2.2.2", "1.1.1.1 2.2.2.2"},
+		{"::1 ::2 1.1.1.1 2.2.2.2", "::1 1.1.1.1 ::2 2.2.2.2"},
+		{"1.1.1.1 2.2.2.2 3.3.3.3 ::1", "1.1.1.1 ::1 2.2.2.2 3.3.3.3"},
+		{"::1 1.1.1.1 ::2 ::3", "::1 1.1.1.1 ::2 ::3"},
+	}
+	for _, tt := range tests {
+		got := interleave(ipList(tt.in))
+		var s []string
+		for _, ip := range got {
+			s = append(s, ip.String())
+		}
+		if strings.Join(s, " ") != tt.want {
+			t.Errorf("%q: got %v, want %q", tt.in, s, tt.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ips := ipList("1.1.1.1 ::1 2.2.2.2")
+	tests := []struct {
+		network string
+		want    int
+	}{
+		{"tcp", 3},
+		{"tcp4", 2},
+		{"tcp6", 1},
+		{"udp4", 2},
+	}
+	for _, tt := range tests {
+		if got := filter(tt.network, ips); len(got) != tt.want {
+			t.Errorf("%v: got %v", tt.network, got)
+		}
+	}
+}
+
+// raceDialer resolve "race.test" to a black hole then a listening address
+func raceDialer(t *testing.T, fallback time.Duration) (*Dialer, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	d := New(500*time.Millisecond, 0, time.Minute)
+	d.FallbackDelay = fallback
+	d.Resolver.Lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if strings.HasPrefix(address, "127.0.0.2:") {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	return d, "race.test:" + port
+}
+
+func TestRace(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback time.Duration
+		min, max time.Duration
+	}{
+		{"fallback delay", 50 * time.Millisecond, 40 * time.Millisecond, 400 * time.Millisecond},
+		{"one by one", -1, 450 * time.Millisecond, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		d, addr := raceDialer(t, tt.fallback)
+		start := time.Now()
+		conn, err := d.Dial("tcp", addr)
+		dt := time.Since(start)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("%v: connected to %v", tt.name, ip)
+		}
+		conn.Close()
+		if dt < tt.min || dt > tt.max {
+			t.Errorf("%v: take %v, want %v ~ %v", tt.name, dt, tt.min, tt.max)
+		}
+	}
+}
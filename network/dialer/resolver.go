@@ -0,0 +1,118 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver cache DNS lookup result for TTL, concurrent lookups of one host share one query
+type Resolver struct {
+	TTL    time.Duration // cache time of found addresses
+	NegTTL time.Duration // cache time of failed lookup, 0 = not cache
+
+	// Lookup do the real query, default net.DefaultResolver.LookupIPAddr
+	Lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	lock  sync.Mutex
+	cache map[string]*dnsEntry
+	now   func() time.Time
+}
+
+type dnsEntry struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+	ready  chan struct{} // closed after lookup done
+}
+
+func NewResolver(ttl time.Duration, negTTL time.Duration) *Resolver {
+	return &Resolver{
+		TTL:    ttl,
+		NegTTL: negTTL,
+		Lookup: net.DefaultResolver.LookupIPAddr,
+		cache:  make(map[string]*dnsEntry),
+		now:    time.Now,
+	}
+}
+
+// LookupIP return cached addresses of host, query if expired
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	r.lock.Lock()
+	e, ok := r.cache[host]
+	if ok {
+		select {
+		case <-e.ready:
+			if r.now().After(e.expire) {
+				ok = false
+			}
+		default:
+			// lookup in progress, wait for it
+		}
+	}
+	if !ok {
+		r.sweep()
+		e = &dnsEntry{ready: make(chan struct{})}
+		r.cache[host] = e
+		r.lock.Unlock()
+		go r.query(host, e)
+	} else {
+		r.lock.Unlock()
+	}
+
+	select {
+	case <-e.ready:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// query not bound to the caller context, so one canceled dial not fail others waiting
+func (r *Resolver) query(host string, e *dnsEntry) {
+	addrs, err := r.Lookup(context.Background(), host)
+	ttl := r.TTL
+	if err != nil {
+		ttl = r.NegTTL
+	}
+	for _, a := range addrs {
+		e.ips = append(e.ips, a.IP)
+	}
+	e.err = err
+	e.expire = r.now().Add(ttl)
+	close(e.ready)
+
+	if ttl <= 0 {
+		r.lock.Lock()
+		if r.cache[host] == e {
+			delete(r.cache, host)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// sweep drop expired entries, caller hold lock
+func (r *Resolver) sweep() {
+	now := r.now()
+	for host, e := range r.cache {
+		select {
+		case <-e.ready:
+			if now.After(e.expire) {
+				delete(r.cache, host)
+			}
+		default:
+		}
+	}
+}
+
+// Flush drop all cached result
+func (r *Resolver) Flush() {
+	r.lock.Lock()
+	r.cache = make(map[string]*dnsEntry)
+	r.lock.Unlock()
+}
@@ -0,0 +1,163 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is the now hook of Resolver
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.lock.Lock()
+	c.t = c.t.Add(d)
+	c.lock.Unlock()
+}
+
+// fakeResolver answer from table, count the queries
+func fakeResolver(ttl, negTTL time.Duration, hosts map[string]string) (*Resolver, *fakeClock, *int32) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	var queries int32
+	r := NewResolver(ttl, negTTL)
+	r.now = clock.now
+	r.Lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&queries, 1)
+		ip, ok := hosts[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	return r, clock, &queries
+}
+
+func TestResolverTTL(t *testing.T) {
+	r, clock, queries := fakeResolver(time.Minute, 5*time.Second, map[string]string{"a.test": "10.0.0.1"})
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		host    string
+		advance time.Duration // before lookup
+		queries int32         // total after lookup
+		ok      bool
+	}{
+		{"first", "a.test", 0, 1, true},
+		{"cached", "a.test", 30 * time.Second, 1, true},
+		{"expired", "a.test", 31 * time.Second, 2, true},
+		{"not found", "b.test", 0, 3, false},
+		{"negative cached", "b.test", 4 * time.Second, 3, false},
+		{"negative expired", "b.test", 2 * time.Second, 4, false},
+		{"IP literal", "10.0.0.9", 0, 4, true},
+	}
+	for _, tt := range tests {
+		clock.add(tt.advance)
+		ips, err := r.LookupIP(ctx, tt.host)
+		if (err == nil) != tt.ok || (tt.ok && len(ips) != 1) {
+			t.Fatalf("%v: got %v %v", tt.name, ips, err)
+		}
+		if n := atomic.LoadInt32(queries); n != tt.queries {
+			t.Fatalf("%v: %v queries, want %v", tt.name, n, tt.queries)
+		}
+	}
+
+	r.Flush()
+	r.LookupIP(ctx, "a.test")
+	if n := atomic.LoadInt32(queries); n != 5 {
+		t.Fatalf("after Flush %v queries", n)
+	}
+}
+
+func TestResolverNoNegCache(t *testing.T) {
+	r, _, queries := fakeResolver(time.Minute, 0, nil)
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupIP(context.Background(), "x.test"); err == nil {
+			t.Fatal("no error")
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 3 {
+		t.Fatalf("%v queries, want 3", n)
+	}
+}
+
+func TestResolverSingleflight(t *testing.T) {
+	r, _, _ := fakeResolver(time.Minute, 0, nil)
+	release := make(chan struct{})
+	var queries int32
+	r.Lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+
+	// one caller give up, others still get the answer
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := r.LookupIP(ctx, "a.test")
+		canceled <- err
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.LookupIP(context.Background(), "a.test")
+			if err == nil && !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+				err = errors.New("wrong answer")
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatalf("canceled caller err = %v", err)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("%v queries, want 1", n)
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	d := New(100*time.Millisecond, 0, time.Minute)
+	block := make(chan struct{})
+	defer close(block)
+	d.Resolver.Lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		<-block
+		return nil, errors.New("late")
+	}
+
+	start := time.Now()
+	_, err := d.Dial("tcp", "slow.test:80")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v", err)
+	}
+	if dt := time.Since(start); dt > time.Second {
+		t.Fatalf("lookup not bound by Timeout, take %v", dt)
+	}
+}
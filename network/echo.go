@@ -1,23 +1,18 @@
+//go:build ignore
+
 package main
 
 import (
 	"flag"
-	"io"
 	"log"
 	"net"
 	"runtime"
-	"sync"
+
+	"github.com/cs8425/go-smalltools/network/pipe"
 )
 
 var (
 	localAddr = flag.String("l", ":1082", "")
-
-	// global recycle buffer
-	copyBuf = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 4096)
-		},
-	}
 )
 
 func main() {
@@ -52,32 +47,7 @@ func echoConn(conn net.Conn) {
 	log.Printf("Connection start: %s\n", conn.RemoteAddr())
 	defer conn.Close()
 
-	cp(conn, conn)
+	res := pipe.Join(conn, conn, 0)
 
-	log.Printf("Connection end: %s\n", conn.RemoteAddr())
-}
-
-func cp(p1, p2 io.ReadWriteCloser) {
-	// start tunnel
-	p1die := make(chan struct{})
-	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p1, p2, buf)
-		close(p1die)
-		copyBuf.Put(buf)
-	}()
-
-	p2die := make(chan struct{})
-	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p2, p1, buf)
-		close(p2die)
-		copyBuf.Put(buf)
-	}()
-
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
-	}
+	log.Printf("Connection end: %s, %v\n", conn.RemoteAddr(), res.AtoB)
 }
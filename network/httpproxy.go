@@ -1,34 +1,40 @@
+//go:build ignore
+
 package main
 
 import (
 	"bytes"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/url"
 	"runtime"
 	"strings"
-	"sync"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/pipe"
 )
 
 var (
 	verbosity = 3
 	port      = flag.String("l", ":4040", "bind port")
 
-	// global recycle buffer
-	copyBuf = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 16384)
-		},
-	}
+	idleTimeout = flag.Int("idle", 0, "close tunnel after no data in both directions (Second), <= 0 disable")
+
+	dialTimeout = flag.Int("dt", 5, "dial timeout (Second)")
+	dialRetry   = flag.Int("dr", 0, "retry failed dial with backoff")
+	dnsTTL      = flag.Int("dns", 60, "cache DNS lookup (Second), 0 = no cache")
+	outDialer   *dialer.Dialer
 )
 
 func main() {
+	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	runtime.GOMAXPROCS(runtime.NumCPU() + 2)
+	outDialer = dialer.New(time.Duration(*dialTimeout)*time.Second, *dialRetry, time.Duration(*dnsTTL)*time.Second)
 
 	listener, err := net.Listen("tcp", *port)
 	if err != nil {
@@ -75,7 +81,7 @@ func handleClientRequest(client net.Conn) {
 	}
 
 	Vlogln(3, "Dial to:", method, address)
-	server, err := net.Dial("tcp", address)
+	server, err := outDialer.Dial("tcp", address)
 	if err != nil {
 		Vlogln(2, "Dial err:", address, err)
 		return
@@ -86,35 +92,8 @@ func handleClientRequest(client net.Conn) {
 		server.Write(b[:n])
 	}
 
-	handleClient(client, server)
-}
-
-func handleClient(p1, p2 io.ReadWriteCloser) {
-	// defer p1.Close()
-	defer p2.Close()
-
-	// start tunnel
-	p1die := make(chan struct{})
-	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p1, p2, buf)
-		close(p1die)
-		copyBuf.Put(buf)
-	}()
-
-	p2die := make(chan struct{})
-	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p2, p1, buf)
-		close(p2die)
-		copyBuf.Put(buf)
-	}()
-
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
-	}
+	res := pipe.Join(client, server, time.Duration(*idleTimeout)*time.Second)
+	Vlogln(3, "close:", address, "up:", res.AtoB, "down:", res.BtoA)
 }
 
 func Vlogf(level int, format string, v ...interface{}) {
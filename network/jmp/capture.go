@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/pipe"
+)
+
+// capture format
+const (
+	CapPcapng = "pcapng" // synthesized TCP/IP packets, open with Wireshark
+	CapHex    = "hex"    // timestamped hexdump log
+	CapRec    = "rec"    // JSON lines of timestamped chunks, for -replay
+)
+
+const (
+	pcapngLinkRaw = 101   // LINKTYPE_RAW, packet begin with IPv4 or IPv6 header
+	capMaxSegment = 32768 // max TCP payload per synthesized packet
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Capture record both directions of every connection of a rule
+type Capture struct {
+	File    string `json:"file"`
+	Format  string `json:"format,omitempty"`   // pcapng (default), hex or rec
+	MaxSize int64  `json:"max_size,omitempty"` // stop after file reach this size (byte), 0 = no limit
+	MaxTime int    `json:"max_time,omitempty"` // stop after this time (Second), 0 = no limit
+
+	lock  sync.Mutex
+	f     *os.File
+	size  int64
+	start time.Time
+	done  bool
+
+	nextID int64 // session id for rec
+}
+
+// Open create (truncate) the capture file
+func (c *Capture) Open() error {
+	switch c.Format {
+	case "":
+		c.Format = CapPcapng
+	case CapPcapng, CapHex, CapRec:
+	default:
+		return errors.New("unknown capture format: " + c.Format)
+	}
+
+	f, err := os.OpenFile(c.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	c.f = f
+	c.start = time.Now()
+
+	if c.Format == CapPcapng {
+		c.write(pcapngSectionHeader())
+		c.write(pcapngInterface())
+	}
+	return nil
+}
+
+// write one record, close the file when hit the limit
+func (c *Capture) write(b []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done {
+		return
+	}
+
+	if (c.MaxSize > 0 && c.size+int64(len(b)) > c.MaxSize) || (c.MaxTime > 0 && time.Since(c.start) > time.Duration(c.MaxTime)*time.Second) {
+		c.done = true
+		c.f.Close()
+		log.Println("[capture]limit reached, stop", c.File)
+		return
+	}
+
+	n, err := c.f.Write(b)
+	c.size += int64(n)
+	if err != nil {
+		c.done = true
+		c.f.Close()
+		log.Println("[capture]write", c.File, err)
+	}
+}
+
+type capEndpoint struct {
+	ip   net.IP
+	port int
+}
+
+// capSession is one proxied connection in capture
+type capSession struct {
+	cap  *Capture
+	name string // for hexdump
+	id   int64  // for rec
+
+	cli  capEndpoint
+	srv  capEndpoint
+	seqC uint32 // next seq client -> server
+	seqS uint32 // next seq server -> client
+
+	lock sync.Mutex
+}
+
+func toEndpoint(addr net.Addr, fake byte) capEndpoint {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return capEndpoint{a.IP, a.Port}
+	case *net.UDPAddr:
+		return capEndpoint{a.IP, a.Port}
+	}
+	return capEndpoint{net.IPv4(127, 0, 0, fake), 0}
+}
+
+func (c *Capture) NewSession(client net.Addr, server net.Addr) *capSession {
+	s := &capSession{
+		cap:  c,
+		name: fmt.Sprintf("%v -> %v", client, server),
+		cli:  toEndpoint(client, 1),
+		srv:  toEndpoint(server, 2),
+	}
+	// mixed family, use IPv4-mapped IPv6 for both
+	if (s.cli.ip.To4() == nil) != (s.srv.ip.To4() == nil) {
+		s.cli.ip = s.cli.ip.To16()
+		s.srv.ip = s.srv.ip.To16()
+	}
+
+	switch c.Format {
+	case CapHex:
+		c.write([]byte(fmt.Sprintf("%v [open] %v\n", capTime(), s.name)))
+		return s
+	case CapRec:
+		s.id = atomic.AddInt64(&c.nextID, 1)
+		s.rec(&recEvent{Event: recOpen, Client: addrString(client), Server: addrString(server)})
+		return s
+	}
+
+	// three-way handshake
+	isnC, isnS := rand.Uint32(), rand.Uint32()
+	s.packet(true, isnC, 0, tcpSYN, nil)
+	s.packet(false, isnS, isnC+1, tcpSYN|tcpACK, nil)
+	s.packet(true, isnC+1, isnS+1, tcpACK, nil)
+	s.seqC, s.seqS = isnC+1, isnS+1
+	return s
+}
+
+// Data record bytes sent in dir (DirUp: client -> server)
+func (s *capSession) Data(dir string, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	switch s.cap.Format {
+	case CapRec:
+		s.rec(&recEvent{Event: recData, Dir: dir, Data: b})
+		return
+	case CapHex:
+		arrow := "->"
+		if dir == DirDown {
+			arrow = "<-"
+		}
+		s.cap.write([]byte(fmt.Sprintf("%v [%v] %v %v bytes\n%v", capTime(), arrow, s.name, len(b), hex.Dump(b))))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(b) > 0 {
+		seg := b
+		if len(seg) > capMaxSegment {
+			seg = seg[:capMaxSegment]
+		}
+		b = b[len(seg):]
+
+		if dir == DirUp {
+			s.packet(true, s.seqC, s.seqS, tcpPSH|tcpACK, seg)
+			s.seqC += uint32(len(seg))
+		} else {
+			s.packet(false, s.seqS, s.seqC, tcpPSH|tcpACK, seg)
+			s.seqS += uint32(len(seg))
+		}
+	}
+}
+
+// Fin record half-close in dir, only rec keep it
+func (s *capSession) Fin(dir string) {
+	if s.cap.Format == CapRec {
+		s.rec(&recEvent{Event: recFin, Dir: dir})
+	}
+}
+
+func (s *capSession) Close() {
+	switch s.cap.Format {
+	case CapHex:
+		s.cap.write([]byte(fmt.Sprintf("%v [close] %v\n", capTime(), s.name)))
+		return
+	case CapRec:
+		s.rec(&recEvent{Event: recClose})
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.packet(true, s.seqC, s.seqS, tcpFIN|tcpACK, nil)
+	s.packet(false, s.seqS, s.seqC+1, tcpFIN|tcpACK, nil)
+	s.packet(true, s.seqC+1, s.seqS+1, tcpACK, nil)
+}
+
+func (s *capSession) packet(fromClient bool, seq uint32, ack uint32, flags byte, payload []byte) {
+	src, dst := s.cli, s.srv
+	if !fromClient {
+		src, dst = s.srv, s.cli
+	}
+	pkt := buildTCPPacket(src, dst, seq, ack, flags, payload)
+	s.cap.write(pcapngPacket(time.Now(), pkt))
+}
+
+// rec write one JSON line, time is microsecond since capture start
+func (s *capSession) rec(ev *recEvent) {
+	ev.Sess = s.id
+	ev.Time = int64(time.Since(s.cap.start) / time.Microsecond)
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	s.cap.write(append(b, '\n'))
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func capTime() string {
+	return time.Now().Format("2006-01-02 15:04:05.000000")
+}
+
+// capConn record data written into it
+type capConn struct {
+	net.Conn
+	sess *capSession
+	dir  string
+}
+
+func (c *capConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sess.Data(c.dir, b[:n])
+	return n, err
+}
+
+// CloseWrite record the half-close then pass it down
+func (c *capConn) CloseWrite() error {
+	c.sess.Fin(c.dir)
+	if !pipe.CloseWrite(c.Conn) {
+		return errors.New("close write not support")
+	}
+	return nil
+}
+
+func (c *capConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func buildTCPPacket(src, dst capEndpoint, seq uint32, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[20:], payload)
+
+	// pseudo header sum
+	var pseudo uint32
+	sip, dip := src.ip.To4(), dst.ip.To4()
+	v4 := sip != nil && dip != nil
+	if !v4 {
+		sip, dip = src.ip.To16(), dst.ip.To16()
+	}
+	for _, ip := range [][]byte{sip, dip} {
+		for i := 0; i < len(ip); i += 2 {
+			pseudo += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	pseudo += 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	if v4 {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = 6    // TCP
+		copy(ip[12:], sip)
+		copy(ip[16:], dip)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		return append(ip, tcp...)
+	}
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // TCP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], sip)
+	copy(ip[24:], dip)
+	return append(ip, tcp...)
+}
+
+func pcapngBlock(typ uint32, body []byte) []byte {
+	pad := (4 - len(body)%4) % 4
+	total := uint32(12 + len(body) + pad)
+
+	buf := bytes.NewBuffer(make([]byte, 0, total))
+	binary.Write(buf, binary.LittleEndian, typ)
+	binary.Write(buf, binary.LittleEndian, total)
+	buf.Write(body)
+	buf.Write(make([]byte, pad))
+	binary.Write(buf, binary.LittleEndian, total)
+	return buf.Bytes()
+}
+
+func pcapngSectionHeader() []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], 0x1A2B3C4D) // byte-order magic
+	binary.LittleEndian.PutUint16(body[4:], 1)          // major version
+	binary.LittleEndian.PutUint16(body[6:], 0)          // minor version
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0)) // section length unknown
+	return pcapngBlock(0x0A0D0D0A, body)
+}
+
+func pcapngInterface() []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], pcapngLinkRaw)
+	binary.LittleEndian.PutUint32(body[4:], 0) // no snap length limit
+	return pcapngBlock(0x00000001, body)
+}
+
+// Enhanced Packet Block, timestamp in microsecond
+func pcapngPacket(t time.Time, pkt []byte) []byte {
+	ts := uint64(t.UnixNano() / 1000)
+	body := make([]byte, 20, 20+len(pkt)+3)
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	body = append(body, pkt...)
+	return pcapngBlock(0x00000006, body)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pseudoSum of the TCP pseudo header, count by hand for checking
+func pseudoSum(src, dst net.IP, tcpLen int) uint32 {
+	var sum uint32
+	for _, ip := range [][]byte{src, dst} {
+		for i := 0; i < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	return sum + 6 + uint32(tcpLen)
+}
+
+// readBlocks split pcapng data into (type, body), fail on bad length
+func readBlocks(t *testing.T, b []byte) (types []uint32, bodies [][]byte) {
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("short block %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		total := int(binary.LittleEndian.Uint32(b[4:]))
+		if total%4 != 0 || total < 12 || total > len(b) {
+			t.Fatalf("block %x bad length %v", typ, total)
+		}
+		if tail := int(binary.LittleEndian.Uint32(b[total-4:])); tail != total {
+			t.Fatalf("block %x length %v, trailer %v", typ, total, tail)
+		}
+		types = append(types, typ)
+		bodies = append(bodies, b[8:total-4])
+		b = b[total:]
+	}
+	return
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		// IPv4 header with checksum field zero
+		{"450000730000400040110000c0a80001c0a800c7", 0xb861},
+		{"", 0xffff},
+		{"01", 0xfeff},
+		{"ffff", 0x0000},
+		{"0001f203f4f5f6f7", 0x220d}, // RFC 1071
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.data)
+		if got := checksum(data, 0); got != tt.want {
+			t.Errorf("%v: got %04x, want %04x", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestBuildTCPPacket(t *testing.T) {
+	payload := []byte("hello, odd length")
+	tests := []struct {
+		name     string
+		src, dst capEndpoint
+		v4       bool
+	}{
+		{"IPv4", capEndpoint{net.ParseIP("10.0.0.1"), 1234}, capEndpoint{net.ParseIP("10.0.0.2"), 80}, true},
+		{"IPv6", capEndpoint{net.ParseIP("fd00::1"), 1234}, capEndpoint{net.ParseIP("fd00::2"), 80}, false},
+		{"mixed", capEndpoint{net.ParseIP("10.0.0.1"), 1234}, capEndpoint{net.ParseIP("fd00::2"), 80}, false},
+	}
+	for _, tt := range tests {
+		pkt := buildTCPPacket(tt.src, tt.dst, 1000, 2000, tcpPSH|tcpACK, payload)
+
+		var tcp []byte
+		var sip, dip net.IP
+		if tt.v4 {
+			if len(pkt) != 40+len(payload) || pkt[0] != 0x45 || pkt[9] != 6 {
+				t.Fatalf("%v: bad IPv4 header %x", tt.name, pkt[:20])
+			}
+			if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+				t.Fatalf("%v: total length %v", tt.name, binary.BigEndian.Uint16(pkt[2:]))
+			}
+			if checksum(pkt[:20], 0) != 0 {
+				t.Fatalf("%v: bad IPv4 checksum", tt.name)
+			}
+			tcp, sip, dip = pkt[20:], pkt[12:16], pkt[16:20]
+		} else {
+			if len(pkt) != 60+len(payload) || pkt[0] != 0x60 || pkt[6] != 6 {
+				t.Fatalf("%v: bad IPv6 header %x", tt.name, pkt[:40])
+			}
+			if int(binary.BigEndian.Uint16(pkt[4:])) != len(pkt)-40 {
+				t.Fatalf("%v: payload length %v", tt.name, binary.BigEndian.Uint16(pkt[4:]))
+			}
+			tcp, sip, dip = pkt[40:], pkt[8:24], pkt[24:40]
+		}
+		if !sip.Equal(tt.src.ip) || !dip.Equal(tt.dst.ip) {
+			t.Fatalf("%v: address %v -> %v", tt.name, sip, dip)
+		}
+
+		if binary.BigEndian.Uint16(tcp[0:]) != 1234 || binary.BigEndian.Uint16(tcp[2:]) != 80 ||
+			binary.BigEndian.Uint32(tcp[4:]) != 1000 || binary.BigEndian.Uint32(tcp[8:]) != 2000 ||
+			tcp[12] != 5<<4 || tcp[13] != tcpPSH|tcpACK {
+			t.Fatalf("%v: bad TCP header %x", tt.name, tcp[:20])
+		}
+		if !bytes.Equal(tcp[20:], payload) {
+			t.Fatalf("%v: payload %q", tt.name, tcp[20:])
+		}
+		if checksum(tcp, pseudoSum(sip, dip, len(tcp))) != 0 {
+			t.Fatalf("%v: bad TCP checksum", tt.name)
+		}
+	}
+}
+
+func TestPcapngBlock(t *testing.T) {
+	for n := 0; n < 8; n++ {
+		b := pcapngBlock(6, bytes.Repeat([]byte{0xaa}, n))
+		types, bodies := readBlocks(t, b)
+		if len(types) != 1 || types[0] != 6 || len(bodies[0])%4 != 0 || len(bodies[0]) < n {
+			t.Fatalf("body %v: got %x", n, b)
+		}
+	}
+
+	ts := time.Unix(1700000000, 123456000)
+	_, bodies := readBlocks(t, pcapngPacket(ts, []byte("abc")))
+	body := bodies[0]
+	us := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+	if us != 1700000000123456 {
+		t.Fatalf("timestamp %v", us)
+	}
+	if binary.LittleEndian.Uint32(body[12:]) != 3 || binary.LittleEndian.Uint32(body[16:]) != 3 || string(body[20:23]) != "abc" {
+		t.Fatalf("packet body %x", body)
+	}
+}
+
+func TestCapturePcapng(t *testing.T) {
+	c := &Capture{File: filepath.Join(t.TempDir(), "cap.pcapng")}
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s := c.NewSession(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80})
+	up := bytes.Repeat([]byte("u"), capMaxSegment+10) // two segments
+	s.Data(DirUp, up)
+	s.Data(DirDown, []byte("down"))
+	s.Close()
+	c.f.Close()
+
+	b, err := os.ReadFile(c.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, bodies := readBlocks(t, b)
+	if len(types) != 2+3+3+3 || types[0] != 0x0A0D0D0A || types[1] != 1 {
+		t.Fatalf("blocks %x", types)
+	}
+	if binary.LittleEndian.Uint32(bodies[0]) != 0x1A2B3C4D || binary.LittleEndian.Uint16(bodies[1]) != pcapngLinkRaw {
+		t.Fatalf("bad section or interface block")
+	}
+
+	// seq of client continue from SYN to FIN
+	type seg struct {
+		flags byte
+		seq   uint32
+		n     int
+	}
+	var cli []seg
+	for _, body := range bodies[2:] {
+		n := int(binary.LittleEndian.Uint32(body[12:]))
+		pkt := body[20 : 20+n]
+		tcp := pkt[20:]
+		if checksum(pkt[:20], 0) != 0 || checksum(tcp, pseudoSum(pkt[12:16], pkt[16:20], len(tcp))) != 0 {
+			t.Fatalf("bad checksum in %x", pkt[:40])
+		}
+		if binary.BigEndian.Uint16(tcp) == 1234 {
+			cli = append(cli, seg{tcp[13], binary.BigEndian.Uint32(tcp[4:]), len(tcp) - 20})
+		}
+	}
+	if len(cli) != 6 || cli[0].flags != tcpSYN || cli[4].flags != tcpFIN|tcpACK {
+		t.Fatalf("client segments %v", cli)
+	}
+	isn := cli[0].seq
+	if cli[2].seq != isn+1 || cli[3].seq != isn+1+capMaxSegment || cli[4].seq != isn+1+uint32(len(up)) {
+		t.Fatalf("client seq %v", cli)
+	}
+	if cli[2].n+cli[3].n != len(up) {
+		t.Fatalf("client payload %v", cli)
+	}
+}
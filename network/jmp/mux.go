@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/mux"
+	"github.com/cs8425/go-smalltools/network/pipe"
+)
+
+func muxConfig() *mux.Config {
+	cfg := mux.DefaultConfig()
+	cfg.KeepAlive = time.Duration(*muxKeepAlive) * time.Second
+	cfg.KeepAliveTimeout = 3 * cfg.KeepAlive
+	return cfg
+}
+
+// MuxClient keep a few long-lived connections to a remote jmp (-muxl),
+// and open one stream per client on the least used one.
+type MuxClient struct {
+	Addr string
+	Size int // max connections
+
+	lock     sync.Mutex
+	sessions []*mux.Session
+	dialing  int // count to Size, so slow dials not start too many
+}
+
+var (
+	muxClients     = make(map[string]*MuxClient)
+	muxClientsLock sync.Mutex
+)
+
+// getMuxClient share connections between rules to the same remote
+func getMuxClient(addr string) *MuxClient {
+	muxClientsLock.Lock()
+	defer muxClientsLock.Unlock()
+	m, ok := muxClients[addr]
+	if !ok {
+		m = NewMuxClient(addr, *muxSize)
+		muxClients[addr] = m
+	}
+	return m
+}
+
+func NewMuxClient(addr string, size int) *MuxClient {
+	if size <= 0 {
+		size = 1
+	}
+	return &MuxClient{
+		Addr: addr,
+		Size: size,
+	}
+}
+
+// Open a stream to target on the remote side
+func (m *MuxClient) Open(target string) (*mux.Stream, error) {
+	sess, err := m.pick()
+	if err != nil {
+		return nil, err
+	}
+	return sess.Open(target)
+}
+
+func (m *MuxClient) pick() (*mux.Session, error) {
+	m.lock.Lock()
+	best := m.best()
+	// reuse idle one, or grow until Size
+	if best != nil && (best.NumStreams() == 0 || len(m.sessions)+m.dialing >= m.Size) {
+		m.lock.Unlock()
+		return best, nil
+	}
+	m.dialing++
+	m.lock.Unlock()
+
+	// not under lock, other clients can still use the connected ones
+	sess, err := m.dial()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dialing--
+	if err != nil {
+		if best = m.best(); best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	m.sessions = append(m.sessions, sess)
+	return sess, nil
+}
+
+// best drop closed sessions and return the least used one, must hold lock
+func (m *MuxClient) best() *mux.Session {
+	alive := m.sessions[:0]
+	for _, s := range m.sessions {
+		if !s.IsClosed() {
+			alive = append(alive, s)
+		}
+	}
+	m.sessions = alive
+
+	var best *mux.Session
+	for _, s := range m.sessions {
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	return best
+}
+
+func (m *MuxClient) dial() (*mux.Session, error) {
+	conn, err := backendDialer.Dial("tcp", m.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if backendPSK != nil {
+		conn, err = pskClient(conn, backendPSK)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Println("[mux]connected", m.Addr)
+	return mux.Client(conn, muxConfig()), nil
+}
+
+// pool not used for this long is dropped, target of streams can be anything
+const muxPoolIdle = 5 * time.Minute
+
+// MuxServer accept mux connections and dial the target of every stream
+type MuxServer struct {
+	Allow map[string]bool // allowed backend address, empty = any, only with -psk
+
+	lock  sync.Mutex
+	pools map[string]*muxPool
+}
+
+type muxPool struct {
+	*Pool
+	conns int       // streams using it
+	last  time.Time // last stream done
+}
+
+func NewMuxServer(allow string) *MuxServer {
+	m := &MuxServer{
+		Allow: make(map[string]bool),
+		pools: make(map[string]*muxPool),
+	}
+	for _, addr := range splitList(allow) {
+		m.Allow[addr] = true
+	}
+	return m
+}
+
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(strings.Replace(list, ",", ";", -1), ";") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (m *MuxServer) ListenAndServe(addr string) error {
+	// any target without both is an open relay, even to our localhost
+	if listenPSK == nil && len(m.Allow) == 0 {
+		return errors.New("mux server need -psk to authenticate clients or -muxt to limit targets")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if len(m.Allow) == 0 {
+		log.Println("[mux]Listening:", addr, "allow any target from PSK clients")
+	} else {
+		log.Println("[mux]Listening:", addr)
+	}
+	go m.evictLoop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("[mux]", err)
+			continue
+		}
+		go m.serveConn(conn)
+	}
+}
+
+func (m *MuxServer) serveConn(conn net.Conn) {
+	if listenPSK != nil {
+		conn = listenPSK.Server(conn)
+		if err := pskServerHandshake(conn); err != nil {
+			log.Println("[mux]PSK handshake", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	m.serveSession(mux.Server(conn, muxConfig()))
+}
+
+func (m *MuxServer) serveSession(sess *mux.Session) {
+	defer sess.Close()
+	log.Println("[mux]session start", sess.RemoteAddr())
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			log.Println("[mux]session end", sess.RemoteAddr(), err)
+			return
+		}
+		go m.serveStream(st)
+	}
+}
+
+// pool per target list, shared by all streams, call release after use
+func (m *MuxServer) pool(target string) (*muxPool, error) {
+	for _, addr := range splitList(target) {
+		if len(m.Allow) > 0 && !m.Allow[addr] {
+			return nil, errors.New("target not allowed: " + addr)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p, ok := m.pools[target]
+	if !ok {
+		np, err := newPool(target, *lbMode)
+		if err != nil {
+			return nil, err
+		}
+		p = &muxPool{Pool: np}
+		m.pools[target] = p
+	}
+	p.conns++
+	return p, nil
+}
+
+func (m *MuxServer) release(p *muxPool) {
+	m.lock.Lock()
+	p.conns--
+	p.last = time.Now()
+	m.lock.Unlock()
+}
+
+// evict drop pools without stream for idle, and stop their health check
+func (m *MuxServer) evict(idle time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for target, p := range m.pools {
+		if p.conns == 0 && time.Since(p.last) >= idle {
+			p.Stop()
+			delete(m.pools, target)
+		}
+	}
+}
+
+func (m *MuxServer) evictLoop() {
+	for range time.Tick(muxPoolIdle / 5) {
+		m.evict(muxPoolIdle)
+	}
+}
+
+func (m *MuxServer) serveStream(st *mux.Stream) {
+	defer st.Close()
+
+	p, err := m.pool(st.Target())
+	if err != nil {
+		log.Println("[mux]", st.RemoteAddr(), err)
+		return
+	}
+	defer m.release(p)
+	rConn, backend, err := p.Dial(st.RemoteAddr(), st.LocalAddr(), *retry)
+	if err != nil {
+		log.Println("[mux]all backend failed", st.Target(), err)
+		return
+	}
+	defer backend.Done()
+	defer rConn.Close()
+
+	res := pipe.Join(st, rConn, time.Duration(*idleTimeout)*time.Second)
+	log.Printf("[mux]close %v#%v -> %v, up: %v, down: %v\n", st.RemoteAddr(), st.ID(), backend.Addr, res.AtoB, res.BtoA)
+}
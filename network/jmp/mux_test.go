@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/mux"
+)
+
+func TestMuxPoolEvict(t *testing.T) {
+	m := NewMuxServer("")
+	a, err := m.pool("127.0.0.1:1;127.0.0.1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.pool("127.0.0.1:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.pool("127.0.0.1:1;127.0.0.1:2"); again != a {
+		t.Fatalf("same target got another pool")
+	}
+	m.release(a)
+	m.release(a)
+	m.release(b)
+
+	// one stream still on b
+	b2, _ := m.pool("127.0.0.1:3")
+	m.evict(0)
+	if len(m.pools) != 1 || m.pools["127.0.0.1:3"] != b2 {
+		t.Fatalf("pools left %v", m.pools)
+	}
+	select {
+	case <-a.stop:
+	default:
+		t.Fatal("health check of evicted pool not stopped")
+	}
+
+	// used recently
+	m.release(b2)
+	m.evict(time.Minute)
+	if len(m.pools) != 1 {
+		t.Fatalf("recently used pool evicted")
+	}
+	m.evict(0)
+	if len(m.pools) != 0 {
+		t.Fatalf("pools left %v", m.pools)
+	}
+}
+
+func TestMuxTargetAllow(t *testing.T) {
+	m := NewMuxServer("127.0.0.1:1, 127.0.0.1:2")
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"127.0.0.1:1", true},
+		{"127.0.0.1:2;127.0.0.1:1", true},
+		{"127.0.0.1:3", false},
+		{"127.0.0.1:1;127.0.0.1:3", false},
+	}
+	for _, tt := range tests {
+		_, err := m.pool(tt.target)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.target, err)
+		}
+	}
+}
+
+// slow dial of a new connection not block streams on the connected one
+func TestMuxClientPick(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	release := make(chan struct{})
+	backendDialer = dialer.New(5*time.Second, 0, 0)
+	backendDialer.Control = func(network, address string, c syscall.RawConn) error {
+		<-release
+		return nil
+	}
+	defer func() { backendDialer = nil }()
+
+	c1, c2 := net.Pipe()
+	busy := mux.Client(c1, nil)
+	srv := mux.Server(c2, nil)
+	defer busy.Close()
+	defer srv.Close()
+	if _, err := busy.Open("x"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMuxClient(ln.Addr().String(), 2)
+	m.sessions = append(m.sessions, busy)
+
+	dialed := make(chan *mux.Session, 1)
+	go func() {
+		sess, err := m.pick()
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- sess
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// size reached with the one dialing, use the busy one right away
+	got := make(chan *mux.Session, 1)
+	go func() {
+		sess, _ := m.pick()
+		got <- sess
+	}()
+	select {
+	case sess := <-got:
+		if sess != busy {
+			t.Fatalf("got a new session while dialing")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pick blocked by dial")
+	}
+
+	close(release)
+	sess := <-dialed
+	if sess == nil || sess == busy || len(m.sessions) != 2 {
+		t.Fatalf("dialed %v, sessions %v", sess, len(m.sessions))
+	}
+	sess.Close()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/proxyproto"
+	"github.com/cs8425/go-smalltools/network/psk"
+	"github.com/cs8425/go-smalltools/network/ws"
+)
+
+var ErrNoBackend = errors.New("no backend available")
+
+// load balance strategy
+const (
+	LbRoundRobin = "rr"   // round-robin
+	LbLeastConn  = "lc"   // least connections
+	LbSourceHash = "hash" // source IP hash
+)
+
+type Backend struct {
+	Addr string
+
+	conns int64 // active connections
+	fails int32 // continuous dial fail count
+	down  int32 // 1 = health check failed
+
+	ejectLock  sync.Mutex
+	ejectUntil time.Time
+}
+
+// Alive check health check state and passive ejection
+func (b *Backend) Alive() bool {
+	if atomic.LoadInt32(&b.down) != 0 {
+		return false
+	}
+	b.ejectLock.Lock()
+	defer b.ejectLock.Unlock()
+	return time.Now().After(b.ejectUntil)
+}
+
+func (b *Backend) Conns() int64 {
+	return atomic.LoadInt64(&b.conns)
+}
+
+func (b *Backend) Done() {
+	atomic.AddInt64(&b.conns, -1)
+}
+
+type Pool struct {
+	Backends []*Backend
+	Strategy string
+	Network  string // "tcp" or "udp"
+
+	DialTimeout time.Duration
+	Dialer      *dialer.Dialer // timeout, retry and DNS cache of each dial
+	MaxFails    int            // passive ejection after continuous dial fail, <= 0 disable
+	EjectTime   time.Duration  // how long a ejected backend stay out
+
+	TLSConfig  *tls.Config // not nil for TLS to backend
+	PSK        *psk.Key    // not nil for PSK encryption to backend
+	ProxyProto int         // send PROXY protocol header version 1 or 2, 0 disable
+
+	next uint32
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPool parse backend list spare by ';' or ','
+func NewPool(list string, strategy string) (*Pool, error) {
+	switch strategy {
+	case LbRoundRobin, LbLeastConn, LbSourceHash:
+	default:
+		return nil, errors.New("unknown load balance strategy: " + strategy)
+	}
+
+	p := &Pool{
+		Strategy:    strategy,
+		Network:     "tcp",
+		DialTimeout: 5 * time.Second,
+		Dialer:      dialer.New(5*time.Second, 0, 0),
+		MaxFails:    3,
+		EjectTime:   30 * time.Second,
+		stop:        make(chan struct{}),
+	}
+	list = strings.Replace(list, ",", ";", -1)
+	for _, addr := range strings.Split(list, ";") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		p.Backends = append(p.Backends, &Backend{Addr: addr})
+	}
+	if len(p.Backends) == 0 {
+		return nil, ErrNoBackend
+	}
+	return p, nil
+}
+
+// Pick select one backend not in tried, return nil if all tried
+func (p *Pool) Pick(client net.Addr, tried map[*Backend]bool) *Backend {
+	alive := make([]*Backend, 0, len(p.Backends))
+	for _, b := range p.Backends {
+		if !tried[b] && b.Alive() {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) == 0 {
+		// all down, still try the rest
+		for _, b := range p.Backends {
+			if !tried[b] {
+				alive = append(alive, b)
+			}
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+
+	switch p.Strategy {
+	case LbLeastConn:
+		best := alive[0]
+		for _, b := range alive[1:] {
+			if b.Conns() < best.Conns() {
+				best = b
+			}
+		}
+		return best
+
+	case LbSourceHash:
+		h := fnv.New32a()
+		h.Write([]byte(addrIP(client)))
+		return alive[int(h.Sum32()%uint32(len(alive)))]
+
+	default: // LbRoundRobin
+		idx := atomic.AddUint32(&p.next, 1) - 1
+		return alive[int(idx%uint32(len(alive)))]
+	}
+}
+
+// Dial try backends one by one, at most `tries` backends
+// client and local are the addresses of the incoming connection
+// caller should call Backend.Done() after connection closed
+func (p *Pool) Dial(client net.Addr, local net.Addr, tries int) (net.Conn, *Backend, error) {
+	if tries <= 0 || tries > len(p.Backends) {
+		tries = len(p.Backends)
+	}
+
+	err := ErrNoBackend
+	tried := make(map[*Backend]bool, tries)
+	for i := 0; i < tries; i++ {
+		b := p.Pick(client, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		var conn net.Conn
+		if ws.IsURL(b.Addr) {
+			// TLS of wss is done by the WebSocket dialer
+			conn, err = wsDial(b.Addr, p.Dialer, p.DialTimeout, p.TLSConfig)
+		} else {
+			conn, err = p.Dialer.Dial(splitNetAddr(b.Addr, p.Network))
+		}
+		if err != nil {
+			log.Println("[pool]dial", b.Addr, err)
+			p.markFail(b)
+			continue
+		}
+		if p.ProxyProto != 0 {
+			conn.SetWriteDeadline(time.Now().Add(p.DialTimeout))
+			err = proxyproto.WriteHeader(conn, p.ProxyProto, client, local)
+			conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				log.Println("[pool]PROXY protocol header", b.Addr, err)
+				conn.Close()
+				p.markFail(b)
+				continue
+			}
+		}
+		if p.TLSConfig != nil && !ws.IsURL(b.Addr) {
+			conn, err = tlsClient(conn, b.Addr, p.TLSConfig)
+			if err != nil {
+				log.Println("[pool]TLS handshake", b.Addr, err)
+				p.markFail(b)
+				continue
+			}
+		}
+		if p.PSK != nil {
+			conn, err = pskClient(conn, p.PSK)
+			if err != nil {
+				log.Println("[pool]PSK handshake", b.Addr, err)
+				p.markFail(b)
+				continue
+			}
+		}
+		atomic.StoreInt32(&b.fails, 0)
+		atomic.AddInt64(&b.conns, 1)
+		return conn, b, nil
+	}
+	return nil, nil, err
+}
+
+func (p *Pool) markFail(b *Backend) {
+	fails := atomic.AddInt32(&b.fails, 1)
+	if p.MaxFails <= 0 || int(fails) < p.MaxFails {
+		return
+	}
+	atomic.StoreInt32(&b.fails, 0)
+
+	b.ejectLock.Lock()
+	b.ejectUntil = time.Now().Add(p.EjectTime)
+	b.ejectLock.Unlock()
+	log.Println("[pool]eject", b.Addr, "for", p.EjectTime)
+}
+
+// HealthCheck run active TCP health check until Stop
+func (p *Pool) HealthCheck(intv time.Duration, timeout time.Duration) {
+	t := time.NewTicker(intv)
+	defer t.Stop()
+	for {
+		for _, b := range p.Backends {
+			go p.checkOne(b, timeout)
+		}
+		select {
+		case <-t.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop the health check of a pool no longer used
+func (p *Pool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *Pool) checkOne(b *Backend, timeout time.Duration) {
+	var down int32
+	// one attempt with its own timeout, share the DNS cache
+	d := *p.Dialer
+	d.Timeout = timeout
+	d.Retries = 0
+	conn, err := d.Dial(splitNetAddr(dialAddr(b.Addr), "tcp"))
+	if err != nil {
+		down = 1
+	} else {
+		conn.Close()
+	}
+
+	old := atomic.SwapInt32(&b.down, down)
+	if old != down {
+		if down != 0 {
+			log.Println("[pool]health check down", b.Addr, err)
+		} else {
+			log.Println("[pool]health check up", b.Addr)
+		}
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpAddr(s string) net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", s)
+	return addr
+}
+
+func TestNewPool(t *testing.T) {
+	tests := []struct {
+		list     string
+		strategy string
+		want     []string
+		ok       bool
+	}{
+		{"a:1", LbRoundRobin, []string{"a:1"}, true},
+		{"a:1;b:2, c:3,", LbLeastConn, []string{"a:1", "b:2", "c:3"}, true},
+		{" ; ,", LbRoundRobin, nil, false},
+		{"a:1", "random", nil, false},
+	}
+	for _, tt := range tests {
+		p, err := NewPool(tt.list, tt.strategy)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%q %v: err = %v", tt.list, tt.strategy, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(p.Backends) != len(tt.want) {
+			t.Fatalf("%q: %v backends", tt.list, len(p.Backends))
+		}
+		for i, b := range p.Backends {
+			if b.Addr != tt.want[i] {
+				t.Errorf("%q: backend %v = %v, want %v", tt.list, i, b.Addr, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	// round-robin, skip tried
+	p, _ := NewPool("a;b;c", LbRoundRobin)
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, p.Pick(nil, nil).Addr)
+	}
+	if want := []string{"a", "b", "c", "a"}; !equalList(got, want) {
+		t.Errorf("rr got %v, want %v", got, want)
+	}
+	tried := map[*Backend]bool{p.Backends[0]: true, p.Backends[1]: true}
+	if b := p.Pick(nil, tried); b != p.Backends[2] {
+		t.Errorf("rr with tried got %v", b.Addr)
+	}
+	tried[p.Backends[2]] = true
+	if b := p.Pick(nil, tried); b != nil {
+		t.Errorf("all tried got %v", b.Addr)
+	}
+
+	// least connections
+	p, _ = NewPool("a;b;c", LbLeastConn)
+	p.Backends[0].conns, p.Backends[1].conns, p.Backends[2].conns = 3, 1, 2
+	if b := p.Pick(nil, nil); b.Addr != "b" {
+		t.Errorf("lc got %v", b.Addr)
+	}
+	if b := p.Pick(nil, map[*Backend]bool{p.Backends[1]: true}); b.Addr != "c" {
+		t.Errorf("lc with tried got %v", b.Addr)
+	}
+
+	// source hash, port not count
+	p, _ = NewPool("a;b;c;d", LbSourceHash)
+	first := p.Pick(tcpAddr("10.0.0.1:1000"), nil)
+	for _, c := range []string{"10.0.0.1:1000", "10.0.0.1:2000", "10.0.0.1:3000"} {
+		if b := p.Pick(tcpAddr(c), nil); b != first {
+			t.Errorf("hash %v got %v, want %v", c, b.Addr, first.Addr)
+		}
+	}
+	seen := make(map[*Backend]bool)
+	for i := 1; i < 50; i++ {
+		seen[p.Pick(tcpAddr(net.IPv4(10, 0, 1, byte(i)).String()+":80"), nil)] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("hash always pick the same backend")
+	}
+}
+
+func TestPickDown(t *testing.T) {
+	p, _ := NewPool("a;b", LbRoundRobin)
+	p.Backends[0].down = 1
+	for i := 0; i < 3; i++ {
+		if b := p.Pick(nil, nil); b.Addr != "b" {
+			t.Fatalf("got down backend %v", b.Addr)
+		}
+	}
+
+	// all down, still try
+	p.Backends[1].down = 1
+	if b := p.Pick(nil, nil); b == nil {
+		t.Fatal("all down got nil")
+	}
+}
+
+func TestMarkFail(t *testing.T) {
+	p, _ := NewPool("a;b", LbRoundRobin)
+	p.MaxFails = 2
+	p.EjectTime = 100 * time.Millisecond
+	a := p.Backends[0]
+
+	p.markFail(a)
+	if !a.Alive() {
+		t.Fatal("ejected before MaxFails")
+	}
+	p.markFail(a)
+	if a.Alive() {
+		t.Fatal("not ejected after MaxFails")
+	}
+	for i := 0; i < 3; i++ {
+		if b := p.Pick(nil, nil); b == a {
+			t.Fatal("ejected backend picked")
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !a.Alive() {
+		t.Fatal("not back after EjectTime")
+	}
+
+	// disabled
+	p.MaxFails = 0
+	for i := 0; i < 5; i++ {
+		p.markFail(a)
+	}
+	if !a.Alive() {
+		t.Fatal("ejected with MaxFails = 0")
+	}
+}
+
+func TestPoolDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// a closed port first, fail over to the live one
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	p, _ := NewPool(dead.Addr().String()+";"+ln.Addr().String(), LbRoundRobin)
+	conn, b, err := p.Dial(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if b != p.Backends[1] || b.Conns() != 1 || p.Backends[0].fails != 1 {
+		t.Fatalf("dialed %v conns %v, fails %v", b.Addr, b.Conns(), p.Backends[0].fails)
+	}
+	b.Done()
+
+	// only one try
+	p.next = 0
+	if _, _, err := p.Dial(nil, nil, 1); err == nil {
+		t.Fatal("dial dead backend success")
+	}
+}
+
+func equalList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/psk"
+)
+
+const pskHandshakeTimeout = 10 * time.Second
+
+var (
+	listenPSK  *psk.Key // -psk, decrypt clients and -muxl
+	backendPSK *psk.Key // -bpsk, encrypt to backend and -mux
+)
+
+// pskServerHandshake finish the handshake of accepted connection before routing
+func pskServerHandshake(conn net.Conn) error {
+	pc, ok := conn.(*psk.Conn)
+	if !ok {
+		return nil
+	}
+	pc.SetDeadline(time.Now().Add(pskHandshakeTimeout))
+	if err := pc.Handshake(); err != nil {
+		return err
+	}
+	return pc.SetDeadline(time.Time{})
+}
+
+func pskClient(conn net.Conn, key *psk.Key) (net.Conn, error) {
+	pc := key.Client(conn)
+	pc.SetDeadline(time.Now().Add(pskHandshakeTimeout))
+	if err := pc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pc.SetDeadline(time.Time{})
+	return pc, nil
+}
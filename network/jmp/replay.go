@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/pipe"
+)
+
+// rec event
+const (
+	recOpen  = "open"
+	recData  = "data"
+	recFin   = "fin" // half-close of Dir
+	recClose = "close"
+)
+
+const replayMatchTimeout = 30 * time.Second
+
+// recEvent is one line of rec capture
+type recEvent struct {
+	Sess   int64  `json:"s"`
+	Time   int64  `json:"t"` // microsecond since capture start
+	Event  string `json:"ev"`
+	Dir    string `json:"d,omitempty"` // data and fin
+	Client string `json:"c,omitempty"` // open only
+	Server string `json:"srv,omitempty"`
+	Data   []byte `json:"b,omitempty"`
+}
+
+type recSession struct {
+	ID     int64
+	Start  int64
+	Client string
+	Server string
+	Events []*recEvent // after open
+}
+
+// LoadRecord read sessions from rec capture in open order
+func LoadRecord(fp string) ([]*recSession, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []*recSession
+	sessions := make(map[int64]*recSession)
+	dec := json.NewDecoder(f)
+	for {
+		ev := &recEvent{}
+		err := dec.Decode(ev)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// file cut by capture limit
+			log.Println("[replay]read", fp, err)
+			break
+		}
+
+		if ev.Event == recOpen {
+			s := &recSession{ID: ev.Sess, Start: ev.Time, Client: ev.Client, Server: ev.Server}
+			sessions[ev.Sess] = s
+			list = append(list, s)
+			continue
+		}
+		if s, ok := sessions[ev.Sess]; ok {
+			s.Events = append(s.Events, ev)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no session in %v", fp)
+	}
+	return list, nil
+}
+
+// Replayer play recorded sessions as fake server (send down, expect up) or fake client
+type Replayer struct {
+	Sessions []*recSession
+	Speed    float64 // 1 = original timing, 2 = twice faster, 0 = no wait
+	Match    bool    // compare peer data with the record, stop on mismatch
+
+	next uint32
+}
+
+func (rp *Replayer) wait(gap int64) {
+	if rp.Speed <= 0 || gap <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(float64(gap)/rp.Speed) * time.Microsecond)
+}
+
+// Play one session on conn, send is the direction we play
+func (rp *Replayer) Play(conn net.Conn, s *recSession, send string) error {
+	expect := DirUp
+	if send == DirUp {
+		expect = DirDown
+	}
+	if !rp.Match {
+		// peer data not checked, drop it so peer never block
+		go io.Copy(ioutil.Discard, conn)
+	}
+
+	// keep the gap between events, matched data count from the time it arrived
+	last := s.Start
+	var got int64 // matched bytes of expect direction
+	for _, ev := range s.Events {
+		if !(rp.Match && ev.Dir == expect) {
+			rp.wait(ev.Time - last)
+		}
+		last = ev.Time
+
+		switch {
+		case ev.Event == recData && ev.Dir == send:
+			if _, err := conn.Write(ev.Data); err != nil {
+				return err
+			}
+
+		case ev.Event == recData && ev.Dir == expect && rp.Match:
+			buf := make([]byte, len(ev.Data))
+			conn.SetReadDeadline(time.Now().Add(replayMatchTimeout))
+			n, err := io.ReadFull(conn, buf)
+			if i := mismatchAt(buf[:n], ev.Data[:n]); i >= 0 {
+				return fmt.Errorf("mismatch at byte %v of %v, want %q got %q", got+int64(i), expect, around(ev.Data, i), around(buf[:n], i))
+			}
+			if err != nil {
+				return err
+			}
+			got += int64(n)
+
+		case ev.Event == recFin && ev.Dir == send:
+			pipe.CloseWrite(conn)
+
+		case ev.Event == recFin && ev.Dir == expect && rp.Match:
+			var b [1]byte
+			conn.SetReadDeadline(time.Now().Add(replayMatchTimeout))
+			if n, err := conn.Read(b[:]); n > 0 || err != io.EOF {
+				return fmt.Errorf("want EOF of %v after %v bytes, got %v bytes, %v", expect, got, n, err)
+			}
+
+		case ev.Event == recClose:
+			return nil
+		}
+	}
+	return nil
+}
+
+// mismatchAt return index of the first different byte, -1 if same
+func mismatchAt(got, want []byte) int {
+	for i := range got {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// around return a few bytes from i for error message
+func around(b []byte, i int) []byte {
+	end := i + 16
+	if end > len(b) {
+		end = len(b)
+	}
+	return b[i:end]
+}
+
+// recAddr parse recorded address for PROXY protocol, nil if not an IP address
+func recAddr(s string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil || addr.IP == nil {
+		return nil
+	}
+	return addr
+}
+
+// Serve act as the fake server, every connection take the next session in turn
+func (rp *Replayer) Serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("[replay]", err)
+			continue
+		}
+		idx := atomic.AddUint32(&rp.next, 1) - 1
+		s := rp.Sessions[int(idx)%len(rp.Sessions)]
+		go func() {
+			defer conn.Close()
+			if err := tlsServerHandshake(conn); err != nil {
+				log.Println("[replay]TLS handshake", conn.RemoteAddr(), err)
+				return
+			}
+			err := rp.Play(conn, s, DirDown)
+			log.Printf("[replay]session %v to %v done: %v\n", s.ID, conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// RunClient act as the fake client, start every session at its recorded time by dial
+func (rp *Replayer) RunClient(dial func(s *recSession) (net.Conn, error)) {
+	var wg sync.WaitGroup
+	base := rp.Sessions[0].Start
+	begin := time.Now()
+	for _, s := range rp.Sessions {
+		if rp.Speed > 0 {
+			at := begin.Add(time.Duration(float64(s.Start-base)/rp.Speed) * time.Microsecond)
+			time.Sleep(time.Until(at))
+		}
+
+		wg.Add(1)
+		go func(s *recSession) {
+			defer wg.Done()
+			conn, err := dial(s)
+			if err != nil {
+				log.Printf("[replay]session %v dial: %v\n", s.ID, err)
+				return
+			}
+			defer conn.Close()
+			err = rp.Play(conn, s, DirUp)
+			log.Printf("[replay]session %v to %v done: %v\n", s.ID, conn.RemoteAddr(), err)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// runReplay is the -replay mode, fake server on -from or fake client to -to
+func runReplay(tlsCfg *tls.Config) error {
+	sessions, err := LoadRecord(*replayFile)
+	if err != nil {
+		return err
+	}
+	if *replaySess > 0 {
+		var pick []*recSession
+		for _, s := range sessions {
+			if s.ID == int64(*replaySess) {
+				pick = append(pick, s)
+			}
+		}
+		if len(pick) == 0 {
+			return fmt.Errorf("session %v not found", *replaySess)
+		}
+		sessions = pick
+	}
+	rp := &Replayer{
+		Sessions: sessions,
+		Speed:    *replaySpeed,
+		Match:    *replayMatch,
+	}
+	log.Printf("[replay]%v sessions from %v, speed: %v, match: %v\n", len(sessions), *replayFile, rp.Speed, rp.Match)
+
+	if !*replayClient {
+		ln, err := net.Listen("tcp", *localAddr)
+		if err != nil {
+			return err
+		}
+		if tlsCfg != nil {
+			ln = tls.NewListener(ln, tlsCfg)
+		}
+		log.Println("[replay]fake server Listening:", *localAddr)
+		rp.Serve(ln)
+		return nil
+	}
+
+	// backend TLS, PSK, PROXY protocol as a normal rule
+	p, err := newPool(*remoteAddr, *lbMode)
+	if err != nil {
+		return err
+	}
+	log.Println("[replay]fake client to", *remoteAddr)
+	rp.RunClient(func(s *recSession) (net.Conn, error) {
+		conn, backend, err := p.Dial(recAddr(s.Client), recAddr(s.Server), *retry)
+		if err != nil {
+			return nil, err
+		}
+		// no load balance across sessions needed
+		backend.Done()
+		return conn, nil
+	})
+	return nil
+}
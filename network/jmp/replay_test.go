@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMismatchAt(t *testing.T) {
+	tests := []struct {
+		got, want string
+		i         int
+	}{
+		{"", "", -1},
+		{"abc", "abc", -1},
+		{"abX", "abc", 2},
+		{"Xbc", "abc", 0},
+		{"ab", "abc", -1}, // short read compare only what got
+	}
+	for _, tt := range tests {
+		if i := mismatchAt([]byte(tt.got), []byte(tt.want)); i != tt.i {
+			t.Errorf("%q %q: got %v, want %v", tt.got, tt.want, i, tt.i)
+		}
+	}
+}
+
+func TestLoadRecord(t *testing.T) {
+	c := &Capture{File: filepath.Join(t.TempDir(), "cap.rec"), Format: CapRec}
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s1 := c.NewSession(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80})
+	s2 := c.NewSession(&net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 2000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80})
+	s1.Data(DirUp, []byte("one"))
+	s2.Data(DirUp, []byte("two"))
+	s1.Fin(DirUp)
+	s1.Close()
+	c.f.Close()
+
+	// cut by capture limit in the middle of a line
+	f, _ := os.OpenFile(c.File, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"s":2,"t":1,"ev":"da`)
+	f.Close()
+
+	list, err := LoadRecord(c.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Client != "10.0.0.1:1000" || list[1].Client != "10.0.0.3:2000" || list[0].Server != "10.0.0.2:80" {
+		t.Fatalf("sessions %+v", list)
+	}
+	if ev := list[0].Events; len(ev) != 3 || string(ev[0].Data) != "one" || ev[1].Event != recFin || ev[2].Event != recClose {
+		t.Fatalf("session 1 events %+v", ev)
+	}
+	if ev := list[1].Events; len(ev) != 1 || string(ev[0].Data) != "two" {
+		t.Fatalf("session 2 events %+v", ev)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.rec")
+	os.WriteFile(empty, nil, 0644)
+	if _, err := LoadRecord(empty); err == nil {
+		t.Fatal("empty record no error")
+	}
+}
+
+func TestPlayMatch(t *testing.T) {
+	s := &recSession{Events: []*recEvent{
+		{Event: recData, Dir: DirUp, Data: []byte("hello")},
+		{Event: recData, Dir: DirDown, Data: []byte("ok")},
+		{Event: recData, Dir: DirUp, Data: []byte("abc")},
+		{Event: recFin, Dir: DirUp},
+		{Event: recClose},
+	}}
+	tests := []struct {
+		name string
+		send []string // by the client, close after all
+		err  string   // "" = match
+	}{
+		{"same", []string{"hello", "abc"}, ""},
+		{"other chunks", []string{"he", "lloab", "c"}, ""},
+		{"first differ", []string{"Hello", "abc"}, "mismatch at byte 0 of up"},
+		{"later differ", []string{"hello", "abX"}, "mismatch at byte 7 of up"},
+		{"short", []string{"hello", "ab"}, "EOF"},
+		{"more data", []string{"hello", "abc", "more"}, "want EOF of up after 8 bytes"},
+	}
+	for _, tt := range tests {
+		srv, cli := net.Pipe()
+		go io.Copy(ioutil.Discard, cli)
+		go func() {
+			for _, b := range tt.send {
+				if _, err := cli.Write([]byte(b)); err != nil {
+					return
+				}
+			}
+			cli.Close()
+		}()
+
+		rp := &Replayer{Sessions: []*recSession{s}, Match: true}
+		err := rp.Play(srv, s, DirDown)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%v: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%v: err = %v, want %q", tt.name, err, tt.err)
+		}
+		srv.Close()
+		cli.Close()
+	}
+}
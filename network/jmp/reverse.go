@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/mux"
+	"github.com/cs8425/go-smalltools/network/pipe"
+)
+
+// reverse tunnel:
+//	NAT side jmp (rule with Reverse) dial the public jmp (-rvl), open a control stream
+//	"bind <addr>", the public side listen on addr and push every public connection
+//	back as a new stream, the NAT side forward it to To like a normal rule.
+
+const (
+	reverseBindPrefix = "bind "
+	reverseMaxBackoff = 30 * time.Second
+)
+
+// addrConn report the public client address carried by the stream
+type addrConn struct {
+	net.Conn
+	raddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *addrConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// serveReverse keep the connection to the public jmp, reconnect with backoff
+func (r *Rule) serveReverse() {
+	log.Printf("[%v] reverse: %v bind %v -> %v (%v)\n", r.Name, r.Reverse, r.From, r.To, r.Lb)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := r.reverseSession()
+		log.Printf("[%v] reverse %v: %v\n", r.Name, r.Reverse, err)
+
+		if time.Since(start) > reverseMaxBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > reverseMaxBackoff {
+			backoff = reverseMaxBackoff
+		}
+	}
+}
+
+func (r *Rule) reverseSession() error {
+	conn, err := backendDialer.Dial("tcp", r.Reverse)
+	if err != nil {
+		return err
+	}
+	// tunnel carry inbound connections of the rule, so use the listen side key
+	conn, err = pskClient(conn, listenPSK)
+	if err != nil {
+		return err
+	}
+	sess := mux.Client(conn, muxConfig())
+	defer sess.Close()
+
+	ctrl, err := sess.Open(reverseBindPrefix + r.From)
+	if err != nil {
+		return err
+	}
+	ctrl.SetReadDeadline(time.Now().Add(time.Duration(*dialTimeout) * time.Second))
+	line, err := bufio.NewReader(ctrl).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	ctrl.SetReadDeadline(time.Time{})
+	if line = strings.TrimSpace(line); line != "ok" {
+		return errors.New("bind refused: " + line)
+	}
+	log.Printf("[%v] reverse bind %v on %v\n", r.Name, r.From, r.Reverse)
+
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return err
+		}
+		if !r.Enabled() {
+			st.Close()
+			continue
+		}
+		var conn net.Conn = st
+		if raddr, err := net.ResolveTCPAddr("tcp", st.Target()); err == nil {
+			conn = &addrConn{st, raddr}
+		}
+		go r.proxyConn(conn)
+	}
+}
+
+// ReverseServer accept NAT side jmp and listen public ports for them
+type ReverseServer struct {
+	Allow map[string]bool // allowed bind address, empty = any
+}
+
+func NewReverseServer(allow string) *ReverseServer {
+	s := &ReverseServer{
+		Allow: make(map[string]bool),
+	}
+	for _, addr := range splitList(allow) {
+		s.Allow[addr] = true
+	}
+	return s
+}
+
+func (s *ReverseServer) ListenAndServe(addr string) error {
+	if listenPSK == nil {
+		return errors.New("reverse server need -psk to authenticate clients")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Println("[reverse]Listening:", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("[reverse]", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *ReverseServer) serveConn(conn net.Conn) {
+	conn = listenPSK.Server(conn)
+	if err := pskServerHandshake(conn); err != nil {
+		log.Println("[reverse]PSK handshake", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	sess := mux.Server(conn, muxConfig())
+	defer sess.Close()
+
+	// first stream is the control stream
+	ctrl, err := sess.Accept()
+	if err != nil {
+		return
+	}
+	defer ctrl.Close()
+	if !strings.HasPrefix(ctrl.Target(), reverseBindPrefix) {
+		log.Println("[reverse]bad request", sess.RemoteAddr(), ctrl.Target())
+		return
+	}
+	bind := strings.TrimPrefix(ctrl.Target(), reverseBindPrefix)
+	if len(s.Allow) > 0 && !s.Allow[bind] {
+		log.Println("[reverse]bind not allowed", sess.RemoteAddr(), bind)
+		ctrl.Write([]byte("not allowed\n"))
+		return
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		log.Println("[reverse]bind", sess.RemoteAddr(), bind, err)
+		ctrl.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	defer ln.Close()
+	ctrl.Write([]byte("ok\n"))
+	log.Println("[reverse]bind", bind, "for", sess.RemoteAddr())
+
+	// stop listen when the client gone
+	go func() {
+		<-sess.CloseChan()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("[reverse]unbind", bind, sess.RemoteAddr())
+			return
+		}
+		go s.pushConn(sess, conn)
+	}
+}
+
+// pushConn send a public connection back to the NAT side
+func (s *ReverseServer) pushConn(sess *mux.Session, conn net.Conn) {
+	defer conn.Close()
+	st, err := sess.Open(conn.RemoteAddr().String())
+	if err != nil {
+		log.Println("[reverse]open stream", sess.RemoteAddr(), err)
+		return
+	}
+	res := pipe.Join(conn, st, time.Duration(*idleTimeout)*time.Second)
+	log.Printf("[reverse]close %v -> %v, up: %v, down: %v\n", conn.RemoteAddr(), sess.RemoteAddr(), res.AtoB, res.BtoA)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/psk"
+)
+
+func tcpEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+// reverseServer run a public side, return its address and a func to drop all NAT side connections
+func reverseServer(t *testing.T, allow string) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var lock sync.Mutex
+	var conns []net.Conn
+	s := NewReverseServer(allow)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, c)
+			lock.Unlock()
+			go s.serveConn(c)
+		}
+	}()
+	drop := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	return ln.Addr().String(), drop
+}
+
+func TestReverse(t *testing.T) {
+	listenPSK = psk.NewKey("secret")
+	backendDialer = dialer.New(time.Second, 0, 0)
+	defer func() {
+		listenPSK, backendDialer = nil, nil
+	}()
+
+	pool, err := NewPool(tcpEcho(t), LbRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, drop := reverseServer(t, "")
+	r := &Rule{Name: "rv", From: freeAddr(t), Reverse: public, pool: pool}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.reverseSession()
+	}()
+
+	// public port bound after the control stream
+	var c net.Conn
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", r.From); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("public port not bound: %v", err)
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q %v", buf, err)
+	}
+	c.Close()
+
+	// NAT side gone, public port closed
+	drop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reverse session not end")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c, err := net.Dial("tcp", r.From); err == nil {
+		c.Close()
+		t.Fatal("public port still bound")
+	}
+
+	// not in allow list
+	public, _ = reverseServer(t, "127.0.0.1:1")
+	r = &Rule{Name: "rv", From: freeAddr(t), Reverse: public, pool: pool}
+	if err := r.reverseSession(); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("bind not allowed err = %v", err)
+	}
+}
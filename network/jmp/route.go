@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	routePeekTimeout = 10 * time.Second
+	routePeekMax     = 16 * 1024 // max bytes to read for finding host
+)
+
+var (
+	errPeekDone = errors.New("peek done")
+	errPeekMax  = errors.New("peek too much data")
+)
+
+type wildRoute struct {
+	suffix string // ".example.com"
+	pool   *Pool
+}
+
+// Router select backend pool by host name
+type Router struct {
+	exact    map[string]*Pool
+	wildcard []wildRoute // longest suffix first
+	def      *Pool
+}
+
+// NewRouter parse 'host=backend,backend;*.example.com=backend;default=backend'
+func NewRouter(list string, newPool func(string) (*Pool, error)) (*Router, error) {
+	r := &Router{
+		exact: make(map[string]*Pool),
+	}
+	for _, ent := range strings.Split(list, ";") {
+		ent = strings.TrimSpace(ent)
+		if ent == "" {
+			continue
+		}
+		parts := strings.SplitN(ent, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("bad route: " + ent)
+		}
+		host := strings.ToLower(strings.TrimSpace(parts[0]))
+		p, err := newPool(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case host == "default" || host == "*":
+			r.def = p
+		case strings.HasPrefix(host, "*."):
+			r.wildcard = append(r.wildcard, wildRoute{host[1:], p})
+		default:
+			r.exact[host] = p
+		}
+	}
+	sort.Slice(r.wildcard, func(i, j int) bool {
+		return len(r.wildcard[i].suffix) > len(r.wildcard[j].suffix)
+	})
+	return r, nil
+}
+
+// Match return nil if no route and no default
+func (r *Router) Match(host string) *Pool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if p, ok := r.exact[host]; ok {
+		return p
+	}
+	for _, w := range r.wildcard {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.pool
+		}
+	}
+	return r.def
+}
+
+// prefixConn replay the peeked bytes before reading from conn
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *prefixConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// readOnlyConn feed crypto/tls, any write is refused
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// limitBuffer keep all data for replay, but error when too much data peeked
+type limitBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	n, _ := b.Buffer.Write(p)
+	if b.Len() > routePeekMax {
+		return n, errPeekMax
+	}
+	return n, nil
+}
+
+// peekHost find TLS SNI or HTTP Host, the returned conn replay all peeked bytes
+// and always usable even host not found
+func peekHost(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	// TLS terminated by us
+	if tc, ok := conn.(*tls.Conn); ok {
+		if sni := tc.ConnectionState().ServerName; sni != "" {
+			return sni, conn, nil
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := &limitBuffer{}
+	tee := io.TeeReader(conn, buf)
+	br := bufio.NewReader(tee)
+
+	var host string
+	first, err := br.Peek(1)
+	if err == nil {
+		if first[0] == 0x16 { // TLS handshake record
+			host, err = peekSNI(conn, br)
+		} else {
+			host, err = peekHTTPHost(br)
+		}
+	}
+
+	// replay everything read from conn, not only consumed by parser
+	pconn := &prefixConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(buf.Bytes()), conn),
+	}
+	return host, pconn, err
+}
+
+func peekSNI(conn net.Conn, r io.Reader) (string, error) {
+	var sni string
+	cfg := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errPeekDone
+		},
+	}
+	err := tls.Server(&readOnlyConn{Conn: conn, r: r}, cfg).Handshake()
+	if sni == "" && err != errPeekDone {
+		if err == nil {
+			err = errors.New("no ClientHello")
+		}
+		return "", err
+	}
+	return sni, nil
+}
+
+func peekHTTPHost(br *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", err
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host, nil
+}
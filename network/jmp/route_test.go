@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterMatch(t *testing.T) {
+	r, err := NewRouter("a.example.com=a:1; *.example.com=wild:1; *.b.example.com=wildb:1,wildb:2; default=def:1", func(list string) (*Pool, error) {
+		return NewPool(list, LbRoundRobin)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want string // first backend, "" = nil
+	}{
+		{"a.example.com", "a:1"},
+		{"A.Example.COM.", "a:1"},
+		{"x.example.com", "wild:1"},
+		{"x.y.example.com", "wild:1"},
+		{"x.b.example.com", "wildb:1"}, // longest suffix
+		{"b.example.com", "wild:1"},
+		{"example.com", "def:1"},
+		{"badexample.com", "def:1"},
+		{"", "def:1"},
+	}
+	for _, tt := range tests {
+		p := r.Match(tt.host)
+		if p == nil || p.Backends[0].Addr != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.host, p, tt.want)
+		}
+	}
+
+	// no default
+	r, _ = NewRouter("*.example.com=wild:1", func(list string) (*Pool, error) {
+		return NewPool(list, LbRoundRobin)
+	})
+	if p := r.Match("example.org"); p != nil {
+		t.Errorf("no default got %v", p.Backends[0].Addr)
+	}
+
+	for _, bad := range []string{"a.example.com", "a.example.com=", "a=b;c"} {
+		if _, err := NewRouter(bad, func(list string) (*Pool, error) {
+			return NewPool(list, LbRoundRobin)
+		}); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+// clientHello record the first flight of a TLS client
+func clientHello(t *testing.T, sni string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		tls.Client(c1, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+		c1.Close()
+	}()
+	c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestPeekHost(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		host string
+		ok   bool
+	}{
+		{"SNI", clientHello(t, "www.example.com"), "www.example.com", true},
+		{"no SNI", clientHello(t, "10.0.0.1"), "", true}, // IP not sent as SNI
+		{"HTTP", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\nbody"), "www.example.com", true},
+		{"HTTP with port", []byte("POST /x HTTP/1.1\r\nHost: Example.com:8080\r\nContent-Length: 0\r\n\r\n"), "Example.com", true},
+		{"HTTP/1.0 no Host", []byte("GET / HTTP/1.0\r\n\r\n"), "", true},
+		{"garbage", []byte("\x01\x02 not http\r\n\r\n"), "", false},
+		{"too long", []byte("GET / HTTP/1.1\r\nX: " + strings.Repeat("a", routePeekMax) + "\r\n\r\n"), "", false},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		go func() {
+			c1.Write(tt.data)
+			c1.Close()
+		}()
+		host, conn, err := peekHost(c2, time.Second)
+		if host != tt.host || (err == nil) != tt.ok {
+			t.Errorf("%v: got %q %v, want %q", tt.name, host, err, tt.host)
+		}
+
+		// everything replayed
+		got, _ := io.ReadAll(conn)
+		if !bytes.Equal(got, tt.data) {
+			t.Errorf("%v: replay %v bytes, want %v", tt.name, len(got), len(tt.data))
+		}
+		c2.Close()
+	}
+}
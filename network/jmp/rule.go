@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/pipe"
+	"github.com/cs8425/go-smalltools/network/proxyproto"
+	"github.com/cs8425/go-smalltools/network/psk"
+	"github.com/cs8425/go-smalltools/network/ratelimit"
+	"github.com/cs8425/go-smalltools/network/ws"
+)
+
+// Rule is one listening address and where to forward
+type Rule struct {
+	Name    string   `json:"name,omitempty"`
+	From    string   `json:"from"`
+	To      string   `json:"to,omitempty"`
+	Route   string   `json:"route,omitempty"`
+	Mux     string   `json:"mux,omitempty"`     // remote jmp -muxl address, To is dialed by the remote
+	Reverse string   `json:"reverse,omitempty"` // public jmp -rvl address, From is listened on the public side
+	Lb      string   `json:"lb,omitempty"`
+	Rx      int      `json:"rx,omitempty"` // byte/sec, 0 = no limit
+	Tx      int      `json:"tx,omitempty"` // byte/sec, 0 = no limit
+	UDP     bool     `json:"udp,omitempty"`
+	Toxics  []*Toxic `json:"toxics,omitempty"`
+
+	Capture *Capture `json:"capture,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"` // refuse new connection
+
+	pool   *Pool
+	router *Router
+	mux    *MuxClient
+	ln     net.Listener
+	udpLn  *net.UDPConn
+	toxics atomic.Value // []*Toxic
+
+	off     int32
+	limLock sync.Mutex
+}
+
+// LoadRules read rule list from JSON file
+func LoadRules(fp string) ([]*Rule, error) {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*Rule
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no rule in " + fp)
+	}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = r.From
+		}
+		if r.Lb == "" {
+			r.Lb = *lbMode
+		}
+		if r.From == "" || (r.To == "" && r.Route == "") {
+			return nil, errors.New("rule " + r.Name + " need from and to (or route)")
+		}
+		for _, t := range r.Toxics {
+			if err := t.init(); err != nil {
+				return nil, err
+			}
+		}
+		rules[i] = r
+	}
+	return rules, nil
+}
+
+// ruleFromFlags build the only rule when no config file
+func ruleFromFlags() *Rule {
+	var capture *Capture
+	if *capFile != "" {
+		capture = &Capture{
+			File:    *capFile,
+			Format:  *capFormat,
+			MaxSize: *capMaxSize,
+			MaxTime: *capMaxTime,
+		}
+	}
+	return &Rule{
+		Capture: capture,
+		Name:    *localAddr,
+		From:    *localAddr,
+		To:      *remoteAddr,
+		Route:   *routeList,
+		Mux:     *muxAddr,
+		Reverse: *reverseAddr,
+		Lb:      *lbMode,
+		Rx:      *RxSpd,
+		Tx:      *TxSpd,
+		UDP:     *udpMode,
+	}
+}
+
+func (r *Rule) GetToxics() []*Toxic {
+	v, _ := r.toxics.Load().([]*Toxic)
+	return v
+}
+
+func (r *Rule) SetToxics(list []*Toxic) {
+	r.toxics.Store(list)
+}
+
+func (r *Rule) Enabled() bool {
+	return atomic.LoadInt32(&r.off) == 0
+}
+
+func (r *Rule) SetEnabled(on bool) {
+	var off int32
+	if !on {
+		off = 1
+	}
+	atomic.StoreInt32(&r.off, off)
+	log.Printf("[%v] enabled: %v\n", r.Name, on)
+}
+
+// Limit return rate limit for new connection
+func (r *Rule) Limit() (rx int, tx int) {
+	r.limLock.Lock()
+	defer r.limLock.Unlock()
+	return r.Rx, r.Tx
+}
+
+func (r *Rule) SetLimit(rx int, tx int) {
+	r.limLock.Lock()
+	r.Rx, r.Tx = rx, tx
+	r.limLock.Unlock()
+	log.Printf("[%v] limit RX: %v, TX: %v\n", r.Name, rx, tx)
+}
+
+// Init create backend pool and listen
+func (r *Rule) Init(trusted []*net.IPNet, tlsCfg *tls.Config) error {
+	var err error
+	r.SetToxics(r.Toxics)
+	if r.Disabled {
+		r.off = 1
+	}
+
+	newRulePool := func(list string) (*Pool, error) {
+		return newPool(list, r.Lb)
+	}
+	if r.Reverse != "" && (r.UDP || r.Route != "" || r.Mux != "") {
+		return errors.New("reverse not support UDP, routing and mux")
+	}
+	if ws.IsURL(r.From) && (r.UDP || r.Reverse != "") {
+		return errors.New("WebSocket listen not support UDP and reverse")
+	}
+	if isUnix(r.From) && (r.UDP || r.Reverse != "") {
+		return errors.New("unix socket listen not support UDP and reverse")
+	}
+	if r.Reverse != "" && listenPSK == nil {
+		return errors.New("reverse need -psk to authenticate with the public jmp")
+	}
+	if r.Mux != "" {
+		if r.UDP || r.Route != "" {
+			return errors.New("mux not support UDP and routing")
+		}
+		r.mux = getMuxClient(r.Mux)
+	} else if r.Route != "" {
+		if r.UDP {
+			return errors.New("routing not support in UDP mode")
+		}
+		r.router, err = NewRouter(r.Route, newRulePool)
+	} else {
+		r.pool, err = newRulePool(r.To)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.UDP {
+		if backendTLSCfg != nil || tlsCfg != nil {
+			return errors.New("TLS not support in UDP mode")
+		}
+		if r.pool.ProxyProto != 0 || len(trusted) > 0 {
+			return errors.New("PROXY protocol not support in UDP mode")
+		}
+		if listenPSK != nil || backendPSK != nil {
+			return errors.New("PSK not support in UDP mode")
+		}
+		for _, b := range r.pool.Backends {
+			if isUnix(b.Addr) || ws.IsURL(b.Addr) {
+				return errors.New("UDP mode only forward to UDP address: " + b.Addr)
+			}
+		}
+		if *hcIntv > 0 {
+			// UDP has no handshake, a dial always success
+			return errors.New("health check not support in UDP mode")
+		}
+		if len(r.GetToxics()) > 0 {
+			return errors.New("toxics not support in UDP mode")
+		}
+		if r.Capture != nil {
+			return errors.New("capture not support in UDP mode")
+		}
+		r.pool.Network = "udp"
+
+		addr, err := net.ResolveUDPAddr("udp", r.From)
+		if err != nil {
+			return err
+		}
+		r.udpLn, err = net.ListenUDP("udp", addr)
+		return err
+	}
+
+	if r.Capture != nil {
+		if err := r.Capture.Open(); err != nil {
+			return err
+		}
+		log.Printf("[%v] capture to %v (%v)\n", r.Name, r.Capture.File, r.Capture.Format)
+	}
+
+	// listen on the public side
+	if r.Reverse != "" {
+		return nil
+	}
+
+	if isUnix(r.From) {
+		r.ln, err = listenUnix(r.From)
+	} else {
+		var addr *net.TCPAddr
+		addr, err = net.ResolveTCPAddr("tcp", dialAddr(r.From))
+		if err == nil {
+			r.ln, err = net.ListenTCP("tcp", addr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// PROXY protocol header come before TLS
+	if len(trusted) > 0 {
+		r.ln = proxyproto.NewListener(r.ln, trusted)
+	}
+	if ws.IsURL(r.From) {
+		// TLS of wss is under HTTP
+		wl, err := wsListen(r.From, r.ln, tlsCfg)
+		if err != nil {
+			r.ln.Close()
+			return err
+		}
+		r.ln = wl
+	} else if tlsCfg != nil {
+		r.ln = tls.NewListener(r.ln, tlsCfg)
+	}
+	if listenPSK != nil {
+		r.ln = &psk.Listener{Listener: r.ln, Key: listenPSK}
+	}
+	return nil
+}
+
+func (r *Rule) Serve() {
+	if r.UDP {
+		r.serveUDP(time.Duration(*udpTimeout) * time.Second)
+		return
+	}
+	if r.Reverse != "" {
+		r.serveReverse()
+		return
+	}
+	defer r.ln.Close()
+
+	rx, tx := r.Limit()
+	log.Printf("[%v] jmp -> client (TX) limit: %v\n", r.Name, tx)
+	log.Printf("[%v] jmp <- client (RX) limit: %v\n", r.Name, rx)
+	if r.router != nil {
+		log.Printf("[%v] Listening: %v -> route %v (%v)\n", r.Name, r.From, r.Route, r.Lb)
+	} else if r.mux != nil {
+		log.Printf("[%v] Listening: %v -> mux %v -> %v\n", r.Name, r.From, r.Mux, r.To)
+	} else {
+		log.Printf("[%v] Listening: %v -> %v (%v)\n", r.Name, r.From, r.To, r.Lb)
+	}
+
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !r.Enabled() {
+			conn.Close()
+			continue
+		}
+		go r.proxyConn(conn)
+	}
+}
+
+func (r *Rule) proxyConn(conn net.Conn) {
+	defer conn.Close()
+
+	if err := tlsServerHandshake(conn); err != nil {
+		log.Println("TLS handshake", conn.RemoteAddr(), err)
+		return
+	}
+	if err := pskServerHandshake(conn); err != nil {
+		log.Println("PSK handshake", conn.RemoteAddr(), err)
+		return
+	}
+
+	p := r.pool
+	if r.router != nil {
+		host, pconn, err := peekHost(conn, routePeekTimeout)
+		if err != nil {
+			log.Println("peek host", conn.RemoteAddr(), err)
+		}
+		conn = pconn
+		p = r.router.Match(host)
+		if p == nil {
+			log.Println("no route for", conn.RemoteAddr(), host)
+			return
+		}
+	}
+
+	var rConn net.Conn
+	var target string
+	if r.mux != nil {
+		st, err := r.mux.Open(r.To)
+		if err != nil {
+			log.Println("mux open", r.Mux, err)
+			return
+		}
+		rConn, target = st, r.Mux+"#"+r.To
+	} else {
+		c, backend, err := p.Dial(conn.RemoteAddr(), conn.LocalAddr(), *retry)
+		if err != nil {
+			log.Println("all backend failed", conn.RemoteAddr(), err)
+			return
+		}
+		defer backend.Done()
+		rConn, target = c, backend.Addr
+	}
+	defer rConn.Close()
+
+	// wrap only when limit or traffic counter needed, so plain TCP can splice
+	var cConn, bConn net.Conn = conn, rConn
+	rx, tx := r.Limit()
+	if adminSrv != nil || rx > 0 || tx > 0 || globalRx.Limited() || globalTx.Limited() {
+		spdlim := ratelimit.NewConn(conn, ratelimit.NewBucket(rx, 0, globalRx), ratelimit.NewBucket(tx, 0, globalTx))
+		cConn = spdlim
+
+		if adminSrv != nil {
+			tun := adminSrv.Add(r.Name, conn.RemoteAddr().String(), target, spdlim)
+			defer adminSrv.Remove(tun)
+		}
+	}
+
+	// capture and toxic apply to write side, so wrap backend for up and client for down
+	if r.Capture != nil {
+		sess := r.Capture.NewSession(conn.RemoteAddr(), rConn.RemoteAddr())
+		defer sess.Close()
+		cConn = &capConn{cConn, sess, DirDown}
+		bConn = &capConn{bConn, sess, DirUp}
+	}
+
+	// toxics can be added by reload when run with config file, so only rule can not have any stay clean for splice
+	if *cfgFile != "" || len(r.GetToxics()) > 0 {
+		down := NewToxicConn(cConn, r, DirDown)
+		up := NewToxicConn(bConn, r, DirUp)
+		defer down.Close()
+		defer up.Close()
+		cConn, bConn = down, up
+	}
+
+	res := pipe.Join(cConn, bConn, time.Duration(*idleTimeout)*time.Second)
+	log.Printf("[%v] close %v -> %v, up: %v, down: %v\n", r.Name, conn.RemoteAddr(), target, res.AtoB, res.BtoA)
+}
+
+// ReloadToxics update toxics of the running rules by name
+func ReloadToxics(rules []*Rule, fp string) {
+	newRules, err := LoadRules(fp)
+	if err != nil {
+		log.Println("reload", fp, err)
+		return
+	}
+	for _, nr := range newRules {
+		for _, r := range rules {
+			if r.Name == nr.Name {
+				r.SetToxics(nr.Toxics)
+				log.Printf("[%v] reload %v toxics\n", r.Name, len(nr.Toxics))
+			}
+		}
+	}
+}
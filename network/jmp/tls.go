@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+func loadCertPool(fp string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + fp)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig for client -> jmp, nil if not enable
+func serverTLSConfig(crt string, key string, clientCA string) (*tls.Config, error) {
+	if crt == "" || key == "" {
+		if clientCA != "" {
+			return nil, errors.New("client CA set without server certificate")
+		}
+		return nil, nil
+	}
+
+	cer, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cer},
+	}
+
+	// mutual TLS
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// backendTLSConfig for jmp -> backend, nil if not enable
+func backendTLSConfig(enable bool, crt string, key string, ca string, sni string, insecure bool) (*tls.Config, error) {
+	if !enable {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         sni,
+		InsecureSkipVerify: insecure,
+	}
+
+	// client certificate
+	if crt != "" && key != "" {
+		cer, err := tls.LoadX509KeyPair(crt, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cer}
+	}
+
+	// only trust this CA
+	if ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// tlsClient do handshake to backend, close conn if failed
+func tlsClient(conn net.Conn, addr string, cfg *tls.Config) (net.Conn, error) {
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg.ServerName = host
+	}
+
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// tlsServerHandshake finish handshake early, so we don't dial backend for bad client
+func tlsServerHandshake(conn net.Conn) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
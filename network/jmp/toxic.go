@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// toxic type
+const (
+	ToxicLatency   = "latency"   // delay every write by Latency +- Jitter
+	ToxicBandwidth = "bandwidth" // limit to Rate byte/sec
+	ToxicSlicer    = "slicer"    // split write into Size +- SizeVar bytes, Delay between
+	ToxicReset     = "reset"     // reset connection after AfterBytes or AfterTime
+	ToxicStall     = "stall"     // stop forwarding for Duration after AfterBytes or AfterTime, forever if Duration = 0
+)
+
+// toxic direction
+const (
+	DirUp   = "up"   // client -> backend
+	DirDown = "down" // backend -> client
+	DirBoth = "both"
+)
+
+var errToxicReset = errors.New("toxic: connection reset")
+
+// all time unit are Millisecond
+type Toxic struct {
+	Name      string  `json:"name,omitempty"`
+	Type      string  `json:"type"`
+	Direction string  `json:"direction,omitempty"` // default both
+	Toxicity  float64 `json:"toxicity,omitempty"`  // probability apply to a connection, 0 = always
+	Disabled  bool    `json:"disabled,omitempty"`
+
+	Latency    int   `json:"latency,omitempty"`
+	Jitter     int   `json:"jitter,omitempty"`
+	Rate       int   `json:"rate,omitempty"`
+	Size       int   `json:"size,omitempty"`
+	SizeVar    int   `json:"size_var,omitempty"`
+	Delay      int   `json:"delay,omitempty"`
+	AfterBytes int64 `json:"after_bytes,omitempty"`
+	AfterTime  int   `json:"after_time,omitempty"`
+	Duration   int   `json:"duration,omitempty"`
+
+	off int32
+}
+
+func (t *Toxic) init() error {
+	switch t.Type {
+	case ToxicLatency, ToxicBandwidth, ToxicSlicer, ToxicReset, ToxicStall:
+	default:
+		return errors.New("unknown toxic type: " + t.Type)
+	}
+	switch t.Direction {
+	case "":
+		t.Direction = DirBoth
+	case DirUp, DirDown, DirBoth:
+	default:
+		return errors.New("unknown toxic direction: " + t.Direction)
+	}
+	if t.Disabled {
+		t.off = 1
+	}
+	return nil
+}
+
+func (t *Toxic) Enabled() bool {
+	return atomic.LoadInt32(&t.off) == 0
+}
+
+func (t *Toxic) SetEnabled(on bool) {
+	var off int32
+	if !on {
+		off = 1
+	}
+	atomic.StoreInt32(&t.off, off)
+}
+
+func (t *Toxic) match(dir string) bool {
+	return t.Direction == DirBoth || t.Direction == dir
+}
+
+func ms(v int) time.Duration {
+	return time.Duration(v) * time.Millisecond
+}
+
+var (
+	rnd     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	rndLock sync.Mutex
+)
+
+func randInt(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	rndLock.Lock()
+	defer rndLock.Unlock()
+	return rnd.Intn(n)
+}
+
+func randFloat() float64 {
+	rndLock.Lock()
+	defer rndLock.Unlock()
+	return rnd.Float64()
+}
+
+// ToxicConn apply toxics to data written into it.
+// The toxic list is fetched from the rule on every write, so toggle take effect at runtime.
+type ToxicConn struct {
+	net.Conn
+	rule *Rule
+	dir  string
+
+	start   time.Time
+	written int64 // only by the writer
+
+	lock         sync.Mutex
+	fired        map[*Toxic]bool // reset or stall already triggered
+	roll         map[*Toxic]bool // toxicity result for this connection
+	stallEnd     time.Time       // write wait until
+	stallForever bool
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// toxicRecheck is the longest wait of after_time timer, so toxics enabled at runtime are picked up
+const toxicRecheck = time.Second
+
+func NewToxicConn(conn net.Conn, rule *Rule, dir string) *ToxicConn {
+	c := &ToxicConn{
+		Conn:  conn,
+		rule:  rule,
+		dir:   dir,
+		start: time.Now(),
+		fired: make(map[*Toxic]bool),
+		roll:  make(map[*Toxic]bool),
+		die:   make(chan struct{}),
+	}
+	go c.timer()
+	return c
+}
+
+func (c *ToxicConn) Close() (err error) {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *ToxicConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *ToxicConn) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-c.die:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// active toxics for this direction and connection, lock held
+func (c *ToxicConn) active() []*Toxic {
+	var out []*Toxic
+	for _, t := range c.rule.GetToxics() {
+		if !t.Enabled() || !t.match(c.dir) {
+			continue
+		}
+		hit, ok := c.roll[t]
+		if !ok {
+			hit = t.Toxicity <= 0 || randFloat() < t.Toxicity
+			c.roll[t] = hit
+		}
+		if hit {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// reset send RST instead of FIN
+func (c *ToxicConn) reset() {
+	raw := c.Conn
+	for {
+		u, ok := raw.(interface{ Unwrap() net.Conn })
+		if !ok {
+			break
+		}
+		raw = u.Unwrap()
+	}
+	if tc, ok := raw.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+// stall start a stall toxic, lock held
+func (c *ToxicConn) stall(t *Toxic) {
+	c.fired[t] = true
+	if t.Duration <= 0 {
+		c.stallForever = true
+		return
+	}
+	if end := time.Now().Add(ms(t.Duration)); end.After(c.stallEnd) {
+		c.stallEnd = end
+	}
+}
+
+// waitStall block while stalled, false if closed
+func (c *ToxicConn) waitStall() bool {
+	c.lock.Lock()
+	end, forever := c.stallEnd, c.stallForever
+	c.lock.Unlock()
+	if forever {
+		<-c.die
+		return false
+	}
+	return c.sleep(time.Until(end))
+}
+
+// timer fire after_time of reset and stall, also on idle connection
+func (c *ToxicConn) timer() {
+	for {
+		c.lock.Lock()
+		wait, reset := c.checkTime()
+		c.lock.Unlock()
+		if reset {
+			c.reset()
+			return
+		}
+		if !c.sleep(wait) {
+			return
+		}
+	}
+}
+
+// checkTime trigger after_time, return when to check again, lock held
+func (c *ToxicConn) checkTime() (time.Duration, bool) {
+	wait := toxicRecheck
+	elapsed := time.Since(c.start)
+	for _, t := range c.active() {
+		if (t.Type != ToxicReset && t.Type != ToxicStall) || t.AfterTime <= 0 || c.fired[t] {
+			continue
+		}
+		if left := ms(t.AfterTime) - elapsed; left > 0 {
+			if left < wait {
+				wait = left
+			}
+			continue
+		}
+		if t.Type == ToxicReset {
+			return 0, true
+		}
+		c.stall(t)
+	}
+	return wait, false
+}
+
+// checkBytes trigger after_bytes, or reset and stall without condition,
+// return bytes can write before the next trigger (-1 = no limit), lock held
+func (c *ToxicConn) checkBytes(toxics []*Toxic) (limit int64, reset bool, stalled bool) {
+	limit = -1
+	for _, t := range toxics {
+		if (t.Type != ToxicReset && t.Type != ToxicStall) || c.fired[t] {
+			continue
+		}
+		hit := t.AfterBytes <= 0 && t.AfterTime <= 0
+		if t.AfterBytes > 0 {
+			left := t.AfterBytes - c.written
+			if left <= 0 {
+				hit = true
+			} else if limit < 0 || left < limit {
+				limit = left
+			}
+		}
+		if !hit {
+			continue
+		}
+		if t.Type == ToxicReset {
+			return 0, true, false
+		}
+		c.stall(t)
+		stalled = true
+	}
+	return limit, false, stalled
+}
+
+func (c *ToxicConn) Write(b []byte) (int, error) {
+	n := 0
+	for {
+		if !c.waitStall() {
+			return n, errToxicReset
+		}
+		c.lock.Lock()
+		toxics := c.active()
+		limit, reset, stalled := c.checkBytes(toxics)
+		c.lock.Unlock()
+		if reset {
+			c.reset()
+			return n, errToxicReset
+		}
+		if stalled {
+			continue
+		}
+
+		// write up to the next after_bytes, then check again
+		chunk := b[n:]
+		if limit >= 0 && limit < int64(len(chunk)) {
+			chunk = chunk[:limit]
+		}
+		w, err := c.writeToxic(chunk, toxics)
+		n += w
+		if err != nil || n == len(b) {
+			return n, err
+		}
+	}
+}
+
+// writeToxic apply latency, bandwidth and slicer
+func (c *ToxicConn) writeToxic(b []byte, toxics []*Toxic) (int, error) {
+	var rate, size, sizeVar, delay int
+	for _, t := range toxics {
+		switch t.Type {
+		case ToxicLatency:
+			d := t.Latency
+			if t.Jitter > 0 {
+				d += randInt(2*t.Jitter+1) - t.Jitter
+			}
+			if !c.sleep(ms(d)) {
+				return 0, errToxicReset
+			}
+
+		case ToxicBandwidth:
+			rate = t.Rate
+
+		case ToxicSlicer:
+			size, sizeVar, delay = t.Size, t.SizeVar, t.Delay
+		}
+	}
+
+	if rate <= 0 && size <= 0 {
+		return c.write(b)
+	}
+
+	n := 0
+	for n < len(b) {
+		chunk := len(b) - n
+		if size > 0 {
+			sz := size
+			if sizeVar > 0 {
+				sz += randInt(2*sizeVar+1) - sizeVar
+			}
+			if sz < 1 {
+				sz = 1
+			}
+			if sz < chunk {
+				chunk = sz
+			}
+		}
+
+		// stall by timer take effect between slices
+		if !c.waitStall() {
+			return n, errToxicReset
+		}
+		w, err := c.write(b[n : n+chunk])
+		n += w
+		if err != nil {
+			return n, err
+		}
+
+		var wait time.Duration
+		if rate > 0 {
+			wait += time.Duration(float64(w) / float64(rate) * float64(time.Second))
+		}
+		if size > 0 && n < len(b) {
+			wait += ms(delay)
+		}
+		if !c.sleep(wait) {
+			return n, errToxicReset
+		}
+	}
+	return n, nil
+}
+
+func (c *ToxicConn) write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
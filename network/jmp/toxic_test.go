@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestToxicInit(t *testing.T) {
+	tests := []struct {
+		toxic Toxic
+		ok    bool
+		dir   string
+	}{
+		{Toxic{Type: ToxicLatency}, true, DirBoth},
+		{Toxic{Type: ToxicReset, Direction: DirUp}, true, DirUp},
+		{Toxic{Type: "drop"}, false, ""},
+		{Toxic{Type: ToxicStall, Direction: "left"}, false, ""},
+	}
+	for _, tt := range tests {
+		err := tt.toxic.init()
+		if (err == nil) != tt.ok {
+			t.Fatalf("%+v: err = %v", tt.toxic, err)
+		}
+		if err == nil && tt.toxic.Direction != tt.dir {
+			t.Errorf("%+v: direction %v", tt.toxic, tt.toxic.Direction)
+		}
+	}
+	off := &Toxic{Type: ToxicLatency, Disabled: true}
+	off.init()
+	if off.Enabled() {
+		t.Error("disabled toxic enabled")
+	}
+}
+
+// toxicPipe return a ToxicConn on dir with toxics, every Read of the peer is sent to the channel
+func toxicPipe(t *testing.T, dir string, toxics ...*Toxic) (*ToxicConn, chan []byte) {
+	for _, tx := range toxics {
+		if err := tx.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &Rule{}
+	r.SetToxics(toxics)
+
+	c1, c2 := net.Pipe()
+	tc := NewToxicConn(c1, r, dir)
+	t.Cleanup(func() {
+		tc.Close()
+		c2.Close()
+	})
+	out := make(chan []byte, 64)
+	go func() {
+		defer close(out)
+		buf := make([]byte, 1024)
+		for {
+			n, err := c2.Read(buf)
+			if err != nil {
+				return
+			}
+			out <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	return tc, out
+}
+
+func TestToxicSlicer(t *testing.T) {
+	tc, out := toxicPipe(t, DirUp, &Toxic{Type: ToxicSlicer, Size: 3})
+	data := []byte("0123456789")
+	if n, err := tc.Write(data); n != len(data) || err != nil {
+		t.Fatalf("write %v %v", n, err)
+	}
+	var got []byte
+	for len(got) < len(data) {
+		b := <-out
+		if len(b) > 3 {
+			t.Fatalf("slice of %v bytes", len(b))
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestToxicLatency(t *testing.T) {
+	tests := []struct {
+		name  string
+		dir   string
+		toxic *Toxic
+		slow  bool
+	}{
+		{"latency", DirDown, &Toxic{Type: ToxicLatency, Latency: 100}, true},
+		{"other direction", DirDown, &Toxic{Type: ToxicLatency, Latency: 100, Direction: DirUp}, false},
+		{"disabled", DirDown, &Toxic{Type: ToxicLatency, Latency: 100, Disabled: true}, false},
+		{"bandwidth", DirUp, &Toxic{Type: ToxicBandwidth, Rate: 100}, true}, // 10 bytes at 100 byte/sec
+		{"stall", DirUp, &Toxic{Type: ToxicStall, AfterBytes: 4, Duration: 100}, true},
+	}
+	for _, tt := range tests {
+		tc, out := toxicPipe(t, tt.dir, tt.toxic)
+		start := time.Now()
+		if n, err := tc.Write([]byte("0123456789")); n != 10 || err != nil {
+			t.Fatalf("%v: write %v %v", tt.name, n, err)
+		}
+		if d := time.Since(start); (d >= 90*time.Millisecond) != tt.slow {
+			t.Errorf("%v: write take %v", tt.name, d)
+		}
+		var got []byte
+		for len(got) < 10 {
+			got = append(got, <-out...)
+		}
+	}
+}
+
+func TestToxicReset(t *testing.T) {
+	// after bytes, only the bytes before sent
+	tc, out := toxicPipe(t, DirUp, &Toxic{Type: ToxicReset, AfterBytes: 4})
+	n, err := tc.Write([]byte("0123456789"))
+	if n != 4 || err != errToxicReset {
+		t.Fatalf("write %v %v", n, err)
+	}
+	var got []byte
+	for b := range out {
+		got = append(got, b...)
+	}
+	if string(got) != "0123" {
+		t.Fatalf("peer got %q", got)
+	}
+
+	// after time, also on idle connection
+	_, out = toxicPipe(t, DirUp, &Toxic{Type: ToxicReset, AfterTime: 100})
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("got data")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not reset")
+	}
+}
+
+func TestToxicToggle(t *testing.T) {
+	toxic := &Toxic{Type: ToxicLatency, Latency: 200}
+	tc, out := toxicPipe(t, DirUp, toxic)
+	toxic.SetEnabled(false)
+	start := time.Now()
+	tc.Write([]byte("x"))
+	<-out
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("disabled toxic still apply, take %v", d)
+	}
+
+	// enabled at runtime, same connection
+	toxic.SetEnabled(true)
+	start = time.Now()
+	tc.Write([]byte("x"))
+	<-out
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatalf("enabled toxic not apply, take %v", d)
+	}
+}
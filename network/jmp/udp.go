@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/admin"
+	"github.com/cs8425/go-smalltools/network/ratelimit"
+)
+
+const (
+	udpBufSize   = 65535
+	udpQueueSize = 64 // per session pending packets, drop when full
+)
+
+type udpSession struct {
+	srv     *udpServer
+	client  *net.UDPAddr
+	conn    net.Conn // to backend, nil until dialed
+	backend *Backend
+	tun     *admin.Tunnel
+
+	lastAct  int64 // UnixNano, atomic
+	queue    chan []byte
+	rx, tx   *ratelimit.Bucket
+	up, down int64 // payload bytes, atomic
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastAct, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastAct)))
+}
+
+type udpServer struct {
+	rule    *Rule
+	ln      *net.UDPConn
+	timeout time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*udpSession // client addr -> session
+}
+
+func (r *Rule) serveUDP(timeout time.Duration) {
+	ln := r.udpLn
+	defer ln.Close()
+
+	rx, tx := r.Limit()
+	log.Printf("[%v] jmp -> client (TX) limit: %v\n", r.Name, tx)
+	log.Printf("[%v] jmp <- client (RX) limit: %v\n", r.Name, rx)
+	log.Printf("[%v] Listening UDP: %v -> %v (%v), idle timeout %v\n", r.Name, r.From, r.To, r.Lb, timeout)
+
+	srv := &udpServer{
+		rule:     r,
+		ln:       ln,
+		timeout:  timeout,
+		sessions: make(map[string]*udpSession),
+	}
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, caddr, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("[udp]read", err)
+			continue
+		}
+
+		s := srv.getSession(caddr)
+		if s == nil {
+			continue
+		}
+		s.touch()
+
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case s.queue <- pkt:
+		default:
+			// queue full, drop like a congested link
+		}
+	}
+}
+
+func (srv *udpServer) getSession(caddr *net.UDPAddr) *udpSession {
+	key := caddr.String()
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	s, ok := srv.sessions[key]
+	if ok {
+		return s
+	}
+	if !srv.rule.Enabled() {
+		return nil
+	}
+
+	// packets wait in queue until dialed, a slow backend not block the read loop and other clients
+	rx, tx := srv.rule.Limit()
+	s = &udpSession{
+		srv:    srv,
+		client: caddr,
+		queue:  make(chan []byte, udpQueueSize),
+		rx:     ratelimit.NewBucket(rx, 0, globalRx),
+		tx:     ratelimit.NewBucket(tx, 0, globalTx),
+		die:    make(chan struct{}),
+	}
+	s.touch()
+	srv.sessions[key] = s
+	go srv.dial(s)
+	return s
+}
+
+// dial the backend outside the lock, then run the session
+func (srv *udpServer) dial(s *udpSession) {
+	conn, backend, err := srv.rule.pool.Dial(s.client, nil, *retry)
+	if err != nil {
+		log.Println("[udp]all backend failed", s.client, err)
+		srv.closeSession(s)
+		return
+	}
+	s.conn, s.backend = conn, backend
+	log.Println("[udp]session start", s.client, "->", backend.Addr)
+	if adminSrv != nil {
+		// under lock, so a kill right after Add still see the tunnel
+		srv.lock.Lock()
+		s.tun = adminSrv.Add(srv.rule.Name, s.client.String(), "udp "+backend.Addr, s)
+		srv.lock.Unlock()
+	}
+
+	go srv.sendLoop(s)
+	srv.recvLoop(s)
+}
+
+func (srv *udpServer) closeSession(s *udpSession) {
+	s.dieOnce.Do(func() {
+		srv.lock.Lock()
+		delete(srv.sessions, s.client.String())
+		tun := s.tun
+		srv.lock.Unlock()
+
+		close(s.die)
+		if s.conn == nil {
+			return
+		}
+		s.conn.Close()
+		s.backend.Done()
+		if tun != nil {
+			adminSrv.Remove(tun)
+		}
+		log.Println("[udp]session end", s.client, "->", s.backend.Addr, "up:", atomic.LoadInt64(&s.up), "down:", atomic.LoadInt64(&s.down))
+	})
+}
+
+// client -> backend
+func (srv *udpServer) sendLoop(s *udpSession) {
+	for {
+		select {
+		case <-s.die:
+			return
+		case pkt := <-s.queue:
+			if !s.rx.Wait(len(pkt), s.die) {
+				return
+			}
+			if _, err := s.conn.Write(pkt); err != nil {
+				log.Println("[udp]write backend", s.backend.Addr, err)
+				continue
+			}
+			atomic.AddInt64(&s.up, int64(len(pkt)))
+		}
+	}
+}
+
+// backend -> client
+func (srv *udpServer) recvLoop(s *udpSession) {
+	defer srv.closeSession(s)
+
+	buf := make([]byte, udpBufSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(srv.timeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if s.idle() < srv.timeout {
+					continue
+				}
+				return
+			}
+			// ICMP unreachable etc., keep session until idle
+			select {
+			case <-s.die:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		s.touch()
+
+		if !s.tx.Wait(n, s.die) {
+			return
+		}
+		if _, err := srv.ln.WriteToUDP(buf[:n], s.client); err != nil {
+			log.Println("[udp]write client", s.client, err)
+			continue
+		}
+		atomic.AddInt64(&s.down, int64(n))
+	}
+}
+
+// Stat, SetRxSpd, SetTxSpd, Close for admin API
+func (s *udpSession) Stat() (rx int64, tx int64) {
+	return atomic.LoadInt64(&s.up), atomic.LoadInt64(&s.down)
+}
+
+func (s *udpSession) SetRxSpd(spd int) {
+	s.rx.SetRate(spd, 0)
+}
+
+func (s *udpSession) SetTxSpd(spd int) {
+	s.tx.SetRate(spd, 0)
+}
+
+func (s *udpSession) Close() error {
+	s.srv.closeSession(s)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/admin"
+)
+
+func udpEcho(t *testing.T) string {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			c.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func tunnels(t *testing.T) []map[string]interface{} {
+	w := httptest.NewRecorder()
+	adminSrv.ServeHTTP(w, httptest.NewRequest("GET", "/tunnels?token=test", nil))
+	var list []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestUDPSession(t *testing.T) {
+	adminSrv = admin.NewServer("test")
+	defer func() { adminSrv = nil }()
+
+	p, err := NewPool(udpEcho(t), LbRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Network = "udp"
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	r := &Rule{Name: "udp", UDP: true, pool: p, udpLn: ln}
+	go r.serveUDP(300 * time.Millisecond)
+
+	c, err := net.DialUDP("udp", nil, ln.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo := func() {
+		c.Write([]byte("ping"))
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 16)
+		if n, err := c.Read(buf); err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("echo %q %v", buf[:n], err)
+		}
+	}
+
+	// registered with the traffic
+	echo()
+	list := tunnels(t)
+	if len(list) != 1 || list[0]["rule"] != "udp" || list[0]["rx"] != 4.0 || list[0]["tx"] != 4.0 {
+		t.Fatalf("tunnels %v", list)
+	}
+
+	// killed by admin API, next packet make a new one
+	w := httptest.NewRecorder()
+	adminSrv.ServeHTTP(w, httptest.NewRequest("POST", "/tunnels/kill?token=test&id=1", nil))
+	if w.Code != http.StatusOK || len(tunnels(t)) != 0 {
+		t.Fatalf("kill: %v %v", w.Code, w.Body)
+	}
+	echo()
+	if list := tunnels(t); len(list) != 1 || list[0]["id"] != 2.0 {
+		t.Fatalf("tunnels after kill %v", list)
+	}
+
+	// removed on expiry
+	time.Sleep(time.Second)
+	if list := tunnels(t); len(list) != 0 {
+		t.Fatalf("tunnels after expiry %v", list)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// address scheme for unix domain socket, both for -from and -to
+const (
+	schemeUnix     = "unix:"          // unix:/path/to.sock
+	schemeAbstract = "unix-abstract:" // unix-abstract:name, Linux abstract namespace
+)
+
+func isUnix(addr string) bool {
+	return strings.HasPrefix(addr, schemeUnix) || strings.HasPrefix(addr, schemeAbstract)
+}
+
+// splitNetAddr map jmp address to network and address of net package,
+// network is returned as-is for non unix address
+func splitNetAddr(addr string, network string) (string, string) {
+	switch {
+	case strings.HasPrefix(addr, schemeAbstract):
+		return "unix", "@" + strings.TrimPrefix(addr, schemeAbstract)
+	case strings.HasPrefix(addr, schemeUnix):
+		return "unix", strings.TrimPrefix(addr, schemeUnix)
+	}
+	return network, addr
+}
+
+// listenUnix listen on socket path, remove the file left by a dead process,
+// the file is removed on close
+func listenUnix(addr string) (net.Listener, error) {
+	_, path := splitNetAddr(addr, "unix")
+	ln, err := net.Listen("unix", path)
+	if err != nil && !strings.HasPrefix(path, "@") {
+		fi, serr := os.Stat(path)
+		if serr != nil || fi.Mode()&os.ModeSocket == 0 {
+			return nil, err
+		}
+		// still in use
+		if c, derr := net.DialTimeout("unix", path, time.Second); derr == nil {
+			c.Close()
+			return nil, err
+		}
+		os.Remove(path)
+		ln, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if *unixMode != "" && !strings.HasPrefix(path, "@") {
+		mode, err := strconv.ParseUint(*unixMode, 8, 32)
+		if err == nil {
+			err = os.Chmod(path, os.FileMode(mode))
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
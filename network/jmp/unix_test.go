@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitNetAddr(t *testing.T) {
+	tests := []struct {
+		addr, network string
+		wantNet       string
+		wantAddr      string
+	}{
+		{"127.0.0.1:80", "tcp", "tcp", "127.0.0.1:80"},
+		{"[::1]:53", "udp", "udp", "[::1]:53"},
+		{"unix:/run/app.sock", "tcp", "unix", "/run/app.sock"},
+		{"unix:rel.sock", "tcp", "unix", "rel.sock"},
+		{"unix-abstract:app", "tcp", "unix", "@app"},
+		{"ws://host/path", "tcp", "tcp", "ws://host/path"},
+	}
+	for _, tt := range tests {
+		network, addr := splitNetAddr(tt.addr, tt.network)
+		if network != tt.wantNet || addr != tt.wantAddr {
+			t.Errorf("%v: got %v %v, want %v %v", tt.addr, network, addr, tt.wantNet, tt.wantAddr)
+		}
+		if isUnix(tt.addr) != (tt.wantNet == "unix") {
+			t.Errorf("%v: isUnix = %v", tt.addr, isUnix(tt.addr))
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.sock")
+	*unixMode = "0600"
+	defer func() { *unixMode = "" }()
+
+	ln, err := listenUnix("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", fi.Mode())
+	}
+
+	// in use
+	if _, err := listenUnix("unix:" + path); err == nil {
+		t.Fatal("listen on socket in use")
+	}
+
+	// left by a dead process
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix("unix:" + path)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed on close: %v", err)
+	}
+
+	// never remove other file
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, []byte("data"), 0644)
+	if _, err := listenUnix("unix:" + file); err == nil {
+		t.Fatal("listen on regular file")
+	}
+	if b, _ := os.ReadFile(file); string(b) != "data" {
+		t.Fatal("regular file changed")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/ws"
+)
+
+// wsDial connect a ws:// or wss:// backend, TLS of wss use the backend TLS config
+func wsDial(addr string, nd *dialer.Dialer, timeout time.Duration, cfg *tls.Config) (net.Conn, error) {
+	d := &ws.Dialer{
+		Timeout:   timeout,
+		TLSConfig: cfg,
+		NetDial:   nd.DialContext,
+	}
+	switch *wsProxy {
+	case "":
+		d.Proxy = http.ProxyFromEnvironment
+	case "direct":
+	default:
+		u, err := url.Parse(*wsProxy)
+		if err != nil {
+			return nil, err
+		}
+		d.Proxy = http.ProxyURL(u)
+	}
+	return d.Dial(addr)
+}
+
+// wsListen accept WebSocket upgrade for rule listen on ws:// or wss://
+func wsListen(from string, ln net.Listener, cfg *tls.Config) (net.Listener, error) {
+	u, err := url.Parse(from)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		if cfg == nil {
+			return nil, errors.New("wss need -crt and -key")
+		}
+		ln = tls.NewListener(ln, cfg)
+	} else if cfg != nil {
+		return nil, errors.New("use wss:// for TLS")
+	}
+	return ws.NewListener(ln, u.Path), nil
+}
+
+// dialAddr return host:port to dial for backend address
+func dialAddr(addr string) string {
+	if !ws.IsURL(addr) {
+		return addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+	return ws.HostPort(u)
+}
@@ -0,0 +1,383 @@
+// Package mux carry many streams over one connection.
+//
+// Every frame is an 8 bytes header followed by the payload:
+//
+//	ver(1) cmd(1) length(2) stream id(4), big endian
+//
+// Each stream has its own receive window, the sender stop when the credit
+// is used up and wait for a window update, so a slow stream not block others.
+// Both sides can open streams, client use odd id and server use even id.
+//
+// The receive loop never write, control frames from it are queued to one writer goroutine,
+// so two sessions can not block each other. A peer make the queue overflow is closed.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const version = 1
+
+// frame command
+const (
+	cmdSYN = iota // open stream, payload is the target
+	cmdFIN        // half-close, no more data from sender
+	cmdPSH        // data
+	cmdRST        // abort stream
+	cmdUPD        // window update, payload is uint32 bytes consumed
+	cmdNOP        // keepalive, id 0 is ping and answered by id 1 (pong)
+)
+
+const (
+	nopPing = 0
+	nopPong = 1
+)
+
+const (
+	headerSize = 8
+
+	// per-stream receive window, fixed so both sides agree without negotiation
+	streamWindow = 256 * 1024
+
+	// pending RST and pong from the receive loop
+	ctrlQueue = 1024
+)
+
+var (
+	ErrClosed     = errors.New("mux: session closed")
+	ErrReset      = errors.New("mux: stream reset by peer")
+	ErrBadVersion = errors.New("mux: bad version")
+	ErrBadID      = errors.New("mux: peer open stream with our id")
+	ErrOverflow   = errors.New("mux: too many pending control frames")
+)
+
+type Config struct {
+	KeepAlive        time.Duration // send keepalive interval, 0 = disable
+	KeepAliveTimeout time.Duration // close session when nothing received, 0 = disable
+	MaxFrame         int           // max payload per frame, <= 65535
+	AcceptBacklog    int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAlive:        10 * time.Second,
+		KeepAliveTimeout: 30 * time.Second,
+		MaxFrame:         32 * 1024,
+		AcceptBacklog:    1024,
+	}
+}
+
+type Session struct {
+	conn net.Conn
+	cfg  *Config
+
+	nextID uint32
+	parity uint32 // of id opened by us
+
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+
+	accept chan *Stream
+
+	wlock sync.Mutex
+	ctrl  chan ctrlFrame
+
+	lastRecv int64 // UnixNano
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client create the dialing side of a session
+func Client(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server create the accepting side of a session
+func Server(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn net.Conn, cfg *Config, firstID uint32) *Session {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if cfg.MaxFrame <= 0 || cfg.MaxFrame > 65535 {
+		cfg.MaxFrame = 65535
+	}
+	s := &Session{
+		conn:     conn,
+		cfg:      cfg,
+		nextID:   firstID,
+		parity:   firstID & 1,
+		streams:  make(map[uint32]*Stream),
+		accept:   make(chan *Stream, cfg.AcceptBacklog),
+		ctrl:     make(chan ctrlFrame, ctrlQueue),
+		lastRecv: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.ctrlLoop()
+	if cfg.KeepAlive > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// Open a new stream, target is passed to the peer as it is
+func (s *Session) Open(target string) (*Stream, error) {
+	if len(target) > 65535 {
+		return nil, errors.New("mux: target too long")
+	}
+
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, ErrClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id, target)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, []byte(target)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept wait for a stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, s.err()
+	}
+}
+
+func (s *Session) Close() error {
+	return s.closeWith(ErrClosed)
+}
+
+func (s *Session) closeWith(err error) error {
+	var cerr error
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		cerr = s.conn.Close()
+	})
+	return cerr
+}
+
+func (s *Session) err() error {
+	select {
+	case <-s.die:
+		return s.dieErr
+	default:
+		return nil
+	}
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan is closed when the session die
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+// NumStreams return active streams
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) remove(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+func (s *Session) get(id uint32) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = version
+	buf[1] = cmd
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	copy(buf[headerSize:], payload)
+
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if s.IsClosed() {
+		return s.err()
+	}
+	_, err := s.conn.Write(buf)
+	if err != nil {
+		s.closeWith(err)
+	}
+	return err
+}
+
+type ctrlFrame struct {
+	cmd byte
+	id  uint32
+}
+
+// sendCtrl queue a frame without payload, never block
+func (s *Session) sendCtrl(cmd byte, id uint32) {
+	select {
+	case s.ctrl <- ctrlFrame{cmd, id}:
+	default:
+		// peer send faster than it read our answers
+		s.closeWith(ErrOverflow)
+	}
+}
+
+func (s *Session) ctrlLoop() {
+	for {
+		select {
+		case f := <-s.ctrl:
+			if s.writeFrame(f.cmd, f.id, nil) != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	var hdr [headerSize]byte
+	buf := make([]byte, 65535)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.closeWith(err)
+			break
+		}
+		if hdr[0] != version {
+			s.closeWith(ErrBadVersion)
+			break
+		}
+		cmd := hdr[1]
+		n := int(binary.BigEndian.Uint16(hdr[2:]))
+		id := binary.BigEndian.Uint32(hdr[4:])
+		payload := buf[:n]
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWith(err)
+			break
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		switch cmd {
+		case cmdSYN:
+			s.handleSYN(id, string(payload))
+		case cmdPSH:
+			if st := s.get(id); st != nil {
+				st.pushData(payload)
+			} else if n > 0 {
+				// closed on our side, stop the sender
+				s.sendCtrl(cmdRST, id)
+			}
+		case cmdFIN:
+			if st := s.get(id); st != nil {
+				st.peerFIN()
+			}
+		case cmdRST:
+			if st := s.get(id); st != nil {
+				st.peerRST()
+			}
+		case cmdUPD:
+			if st := s.get(id); st != nil && n >= 4 {
+				st.addCredit(int(binary.BigEndian.Uint32(payload)))
+			}
+		case cmdNOP:
+			// answer ping, so liveness not depend on the keepalive interval of peer
+			if id == nopPing {
+				s.sendCtrl(cmdNOP, nopPong)
+			}
+		}
+	}
+
+	// wake up all streams
+	s.lock.Lock()
+	for _, st := range s.streams {
+		st.notifyRead()
+		st.notifyWrite()
+	}
+	s.lock.Unlock()
+}
+
+func (s *Session) handleSYN(id uint32, target string) {
+	// would take over a stream from Open, a broken or hostile peer
+	if id&1 == s.parity {
+		s.closeWith(ErrBadID)
+		return
+	}
+
+	s.lock.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.lock.Unlock()
+		return
+	}
+	st := newStream(s, id, target)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.remove(id)
+		s.sendCtrl(cmdRST, id)
+	}
+}
+
+func (s *Session) keepalive() {
+	t := time.NewTicker(s.cfg.KeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if s.cfg.KeepAliveTimeout > 0 {
+				last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+				if time.Since(last) > s.cfg.KeepAliveTimeout {
+					s.closeWith(errors.New("mux: keepalive timeout"))
+					return
+				}
+			}
+			s.writeFrame(cmdNOP, nopPing, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func pair(t *testing.T, cfg func() *Config) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	cli, srv := Client(c1, cfg()), Server(c2, cfg())
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return cli, srv
+}
+
+func accept(t *testing.T, s *Session) *Stream {
+	ch := make(chan *Stream, 1)
+	go func() {
+		st, err := s.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- st
+	}()
+	select {
+	case st := <-ch:
+		return st
+	case <-time.After(2 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	return nil
+}
+
+// writeRaw send one frame by hand, like a broken peer
+func writeRaw(c net.Conn, cmd byte, id uint32, payload []byte) {
+	hdr := []byte{version, cmd, byte(len(payload) >> 8), byte(len(payload)), byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	c.Write(append(hdr, payload...))
+}
+
+func waitClosed(t *testing.T, s *Session, d time.Duration) error {
+	select {
+	case <-s.CloseChan():
+		return s.err()
+	case <-time.After(d):
+		t.Fatalf("session not closed after %v", d)
+	}
+	return nil
+}
+
+func TestOpenAccept(t *testing.T) {
+	cli, srv := pair(t, DefaultConfig)
+
+	st1, err := cli.Open("10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2 := accept(t, srv)
+	if st2.Target() != "10.0.0.1:80" || st2.ID() != st1.ID() || st1.ID()%2 != 1 {
+		t.Fatalf("target %q, id %v / %v", st2.Target(), st1.ID(), st2.ID())
+	}
+
+	go st1.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(st2, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q %v", buf, err)
+	}
+	go st2.Write([]byte("pong"))
+	if _, err := io.ReadFull(st1, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q %v", buf, err)
+	}
+
+	// server open too, with even id
+	st3, err := srv.Open("back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st4 := accept(t, cli)
+	if st4.Target() != "back" || st3.ID()%2 != 0 || st4.ID() != st3.ID() {
+		t.Fatalf("target %q, id %v / %v", st4.Target(), st3.ID(), st4.ID())
+	}
+	if n := cli.NumStreams(); n != 2 {
+		t.Fatalf("client streams %v", n)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	cli, srv := pair(t, DefaultConfig)
+	st1, err := cli.Open("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2 := accept(t, srv)
+
+	// nobody read, the writer stop at the window
+	data := bytes.Repeat([]byte("a"), 2*streamWindow)
+	st1.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := st1.Write(data)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write err = %v, want timeout", err)
+	}
+	if n != streamWindow {
+		t.Fatalf("wrote %v before window full, want %v", n, streamWindow)
+	}
+
+	// a slow stream not block others
+	st3, err := cli.Open("y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st4 := accept(t, srv)
+	go st3.Write([]byte("other"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(st4, buf); err != nil || string(buf) != "other" {
+		t.Fatalf("other stream read %q %v", buf, err)
+	}
+
+	// read half the window, the update let the writer go on
+	if _, err := io.ReadFull(st2, make([]byte, streamWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	st1.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	rest := data[n:]
+	done := make(chan error, 1)
+	go func() {
+		_, err := st1.Write(rest)
+		st1.CloseWrite()
+		done <- err
+	}()
+	got, err := ioutil.ReadAll(st2)
+	if err != nil || len(got) != streamWindow/2+len(rest) {
+		t.Fatalf("read %v bytes after update, err %v", len(got), err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write after update: %v", err)
+	}
+}
+
+func TestWindowViolation(t *testing.T) {
+	c1, c2 := net.Pipe()
+	srv := Server(c2, DefaultConfig())
+	defer srv.Close()
+	go io.Copy(ioutil.Discard, c1)
+
+	writeRaw(c1, cmdSYN, 1, []byte("x"))
+	st := accept(t, srv)
+	chunk := make([]byte, 65535)
+	for sent := 0; sent <= streamWindow; sent += len(chunk) {
+		writeRaw(c1, cmdPSH, 1, chunk)
+	}
+	st.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, st); err != ErrReset {
+		t.Fatalf("read err = %v, want reset", err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	cli, srv := pair(t, DefaultConfig)
+	st1, err := cli.Open("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2 := accept(t, srv)
+
+	st1.Write([]byte("request"))
+	st1.CloseWrite()
+	req, err := ioutil.ReadAll(st2)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("server read %q %v", req, err)
+	}
+
+	// still can reply after peer FIN
+	if _, err := st2.Write([]byte("response")); err != nil {
+		t.Fatalf("write after peer FIN: %v", err)
+	}
+	st2.Close()
+	resp, err := ioutil.ReadAll(st1)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("client read %q %v", resp, err)
+	}
+	if _, err := st1.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after CloseWrite err = %v", err)
+	}
+
+	// both FIN, stream removed on both sides
+	time.Sleep(50 * time.Millisecond)
+	if n1, n2 := cli.NumStreams(), srv.NumStreams(); n1 != 0 || n2 != 0 {
+		t.Fatalf("streams left %v / %v", n1, n2)
+	}
+}
+
+func TestReset(t *testing.T) {
+	cli, srv := pair(t, DefaultConfig)
+	st1, err := cli.Open("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2 := accept(t, srv)
+
+	// data to a closed stream is answered by RST
+	st2.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := st1.Write([]byte("x"))
+		if err == ErrReset {
+			break
+		}
+		if err != nil {
+			t.Fatalf("write err = %v, want reset", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no reset from peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := st1.Read(make([]byte, 1)); err != ErrReset {
+		t.Fatalf("read err = %v, want reset", err)
+	}
+	if n := cli.NumStreams(); n != 0 {
+		t.Fatalf("streams left %v", n)
+	}
+
+	// other streams not affected
+	st3, err := cli.Open("y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st4 := accept(t, srv)
+	go st3.Write([]byte("ok"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(st4, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read %q %v", buf, err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	cfg := func() *Config {
+		c := DefaultConfig()
+		c.KeepAlive = 50 * time.Millisecond
+		c.KeepAliveTimeout = 200 * time.Millisecond
+		return c
+	}
+
+	// ping answered, alive longer than timeout without any stream
+	cli, srv := pair(t, cfg)
+	time.Sleep(500 * time.Millisecond)
+	if cli.IsClosed() || srv.IsClosed() {
+		t.Fatalf("closed with keepalive: %v / %v", cli.err(), srv.err())
+	}
+
+	// peer read but never answer
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	s := Client(c1, cfg())
+	err := waitClosed(t, s, 2*time.Second)
+	if err == nil || err.Error() != "mux: keepalive timeout" {
+		t.Fatalf("closed by %v", err)
+	}
+	if _, err := s.Open("x"); err != ErrClosed {
+		t.Fatalf("open after close err = %v", err)
+	}
+}
+
+func TestBadID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	cli := Client(c1, DefaultConfig())
+
+	st, err := cli.Open("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SYN with client parity, the next Open would take it over
+	writeRaw(c2, cmdSYN, st.ID()+2, []byte("evil"))
+	if err := waitClosed(t, cli, 2*time.Second); err != ErrBadID {
+		t.Fatalf("closed by %v, want %v", err, ErrBadID)
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	srv := Server(c1, DefaultConfig())
+	go c2.Write([]byte{9, cmdNOP, 0, 0, 0, 0, 0, 0})
+	if err := waitClosed(t, srv, 2*time.Second); err != ErrBadVersion {
+		t.Fatalf("closed by %v", err)
+	}
+}
+
+func TestCtrlOverflow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	srv := Server(c1, DefaultConfig())
+
+	// flood ping and never read the pong
+	go func() {
+		for i := 0; i < ctrlQueue+16; i++ {
+			writeRaw(c2, cmdNOP, nopPing, nil)
+		}
+	}()
+	if err := waitClosed(t, srv, 2*time.Second); err != ErrOverflow {
+		t.Fatalf("closed by %v, want %v", err, ErrOverflow)
+	}
+}
@@ -0,0 +1,299 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is one logical connection in a session, implement net.Conn.
+// CloseWrite send FIN, the peer read EOF after all data.
+type Stream struct {
+	id     uint32
+	sess   *Session
+	target string
+
+	lock     sync.Mutex
+	buf      bytes.Buffer // received, not read yet
+	consumed int          // read but not reported to peer
+	credit   int          // bytes can send before next window update
+	finRecv  bool
+	finSent  bool
+	reset    bool
+	closed   bool
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	wlock      sync.Mutex // one writer at a time, keep data order
+
+	rdeadline time.Time
+	wdeadline time.Time
+}
+
+func newStream(s *Session, id uint32, target string) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		target:     target,
+		credit:     streamWindow,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Target return what the opener asked for
+func (st *Stream) Target() string {
+	return st.target
+}
+
+func (st *Stream) Session() *Session {
+	return st.sess
+}
+
+func (st *Stream) notifyRead() {
+	select {
+	case st.readEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) notifyWrite() {
+	select {
+	case st.writeEvent <- struct{}{}:
+	default:
+	}
+}
+
+// wait for event, deadline or session die
+func (st *Stream) wait(ev chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ev:
+		return nil
+	case <-st.sess.die:
+		return st.sess.err()
+	case <-timeout:
+		return errTimeout
+	}
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		st.lock.Lock()
+		if st.closed {
+			st.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			var upd int
+			if st.consumed >= streamWindow/2 {
+				upd, st.consumed = st.consumed, 0
+			}
+			st.lock.Unlock()
+
+			if upd > 0 {
+				var p [4]byte
+				binary.BigEndian.PutUint32(p[:], uint32(upd))
+				st.sess.writeFrame(cmdUPD, st.id, p[:])
+			}
+			return n, nil
+		}
+		reset, fin, deadline := st.reset, st.finRecv, st.rdeadline
+		st.lock.Unlock()
+
+		switch {
+		case reset:
+			return 0, ErrReset
+		case fin:
+			return 0, io.EOF
+		}
+		if err := st.wait(st.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	st.wlock.Lock()
+	defer st.wlock.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		st.lock.Lock()
+		closed, reset, fin, credit, deadline := st.closed, st.reset, st.finSent, st.credit, st.wdeadline
+		n := len(b)
+		if n > credit {
+			n = credit
+		}
+		if n > st.sess.cfg.MaxFrame {
+			n = st.sess.cfg.MaxFrame
+		}
+		if n > 0 && !closed && !reset && !fin {
+			st.credit -= n
+		}
+		st.lock.Unlock()
+
+		switch {
+		case closed, fin:
+			return written, io.ErrClosedPipe
+		case reset:
+			return written, ErrReset
+		}
+		if n <= 0 {
+			if err := st.wait(st.writeEvent, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		if err := st.sess.writeFrame(cmdPSH, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite send FIN once
+func (st *Stream) CloseWrite() error {
+	st.lock.Lock()
+	if st.finSent || st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.lock.Unlock()
+
+	err := st.sess.writeFrame(cmdFIN, st.id, nil)
+	if done {
+		st.sess.remove(st.id)
+	}
+	return err
+}
+
+// Close send FIN if not sent, data from peer after this will be answered by RST
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.lock.Unlock()
+
+	err := st.CloseWrite()
+	st.sess.remove(st.id)
+	st.notifyRead()
+	st.notifyWrite()
+	return err
+}
+
+func (st *Stream) pushData(b []byte) {
+	st.lock.Lock()
+	if st.closed || st.finRecv {
+		st.lock.Unlock()
+		return
+	}
+	if st.buf.Len()+len(b) > streamWindow {
+		// peer not respect the window
+		st.reset = true
+		st.lock.Unlock()
+		st.sess.remove(st.id)
+		st.sess.sendCtrl(cmdRST, st.id)
+		st.notifyRead()
+		st.notifyWrite()
+		return
+	}
+	st.buf.Write(b)
+	st.lock.Unlock()
+	st.notifyRead()
+}
+
+func (st *Stream) peerFIN() {
+	st.lock.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.lock.Unlock()
+	if done {
+		st.sess.remove(st.id)
+	}
+	st.notifyRead()
+}
+
+func (st *Stream) peerRST() {
+	st.lock.Lock()
+	st.reset = true
+	st.lock.Unlock()
+	st.sess.remove(st.id)
+	st.notifyRead()
+	st.notifyWrite()
+}
+
+func (st *Stream) addCredit(n int) {
+	st.lock.Lock()
+	st.credit += n
+	st.lock.Unlock()
+	st.notifyWrite()
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline take effect on next wait
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.rdeadline = t
+	st.lock.Unlock()
+	st.notifyRead()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.wdeadline = t
+	st.lock.Unlock()
+	st.notifyWrite()
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
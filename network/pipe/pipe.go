@@ -0,0 +1,239 @@
+// Package pipe copy data between two connections in both directions.
+//
+// When one direction hit EOF, the write side of the other connection is closed
+// by CloseWrite (TCP FIN, TLS close_notify), and Join keep waiting for the other
+// direction, so half-closed protocols are not truncated.
+package pipe
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// why a direction ended
+const (
+	ReasonEOF    = "eof"    // source closed normally
+	ReasonError  = "error"  // read or write error, see Stat.Err
+	ReasonIdle   = "idle"   // no data in both directions for idle timeout
+	ReasonClosed = "closed" // closed because the other direction failed
+)
+
+const BufSize = 16 * 1024
+
+// use splice(2) when both ends are plain *net.TCPConn (Linux only)
+var useSplice = true
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, BufSize)
+	},
+}
+
+// Stat of one direction
+type Stat struct {
+	Bytes  int64
+	Reason string
+	Err    error
+}
+
+func (s Stat) String() string {
+	if s.Err != nil && s.Reason == ReasonError {
+		return fmt.Sprintf("%v bytes (%v: %v)", s.Bytes, s.Reason, s.Err)
+	}
+	return fmt.Sprintf("%v bytes (%v)", s.Bytes, s.Reason)
+}
+
+// Result of Join, AtoB is data read from a and written to b
+type Result struct {
+	AtoB Stat
+	BtoA Stat
+}
+
+// closeWriter is implemented by *net.TCPConn, *net.UnixConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// unwrapper is implemented by connection wrappers
+type unwrapper interface {
+	Unwrap() net.Conn
+}
+
+// CloseWrite find the first CloseWrite through the wrappers,
+// return false if not support.
+func CloseWrite(c io.Writer) bool {
+	for c != nil {
+		if cw, ok := c.(closeWriter); ok {
+			return cw.CloseWrite() == nil
+		}
+		u, ok := c.(unwrapper)
+		if !ok {
+			return false
+		}
+		c = u.Unwrap()
+	}
+	return false
+}
+
+type joiner struct {
+	a, b io.ReadWriteCloser
+
+	last int64 // UnixNano of last activity
+
+	abortOnce   sync.Once
+	abortReason atomic.Value // string
+}
+
+func (j *joiner) touch() {
+	atomic.StoreInt64(&j.last, time.Now().UnixNano())
+}
+
+func (j *joiner) abort(reason string) {
+	j.abortOnce.Do(func() {
+		j.abortReason.Store(reason)
+		j.a.Close()
+		j.b.Close()
+	})
+}
+
+func (j *joiner) aborted() string {
+	r, _ := j.abortReason.Load().(string)
+	return r
+}
+
+func (j *joiner) copyHalf(dst io.Writer, src io.Reader) (st Stat) {
+	if j.splice(dst, src, &st) {
+		return st
+	}
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			j.touch()
+			w, werr := dst.Write(buf[:n])
+			st.Bytes += int64(w)
+			if werr == nil && w != n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				st.Reason, st.Err = ReasonError, werr
+				break
+			}
+		}
+		if err == io.EOF {
+			st.Reason = ReasonEOF
+			break
+		}
+		if err != nil {
+			st.Reason, st.Err = ReasonError, err
+			break
+		}
+	}
+
+	j.fixReason(&st)
+	return st
+}
+
+// splice fast path, any wrapper (limit, TLS, counter) fallback to the buffered copy
+func (j *joiner) splice(dst io.Writer, src io.Reader, st *Stat) bool {
+	if !useSplice {
+		return false
+	}
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	s, ok := src.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	n, ok, err := spliceCopy(d, s, j.touch)
+	if !ok {
+		return false
+	}
+	st.Bytes = n
+	st.Reason = ReasonEOF
+	if err != nil {
+		st.Reason, st.Err = ReasonError, err
+	}
+	j.fixReason(st)
+	return true
+}
+
+// closed by us, report why
+func (j *joiner) fixReason(st *Stat) {
+	if st.Reason == ReasonError {
+		if r := j.aborted(); r != "" {
+			st.Reason = r
+		}
+	}
+}
+
+// Join copy a <-> b until both directions end, then close both.
+// idle <= 0 disable the idle timeout.
+// If a == b (echo), only one direction is copied.
+func Join(a, b io.ReadWriteCloser, idle time.Duration) *Result {
+	j := &joiner{a: a, b: b}
+	j.touch()
+	res := &Result{}
+
+	run := func(dst io.ReadWriteCloser, src io.ReadWriteCloser, st *Stat, done chan struct{}) {
+		defer close(done)
+		*st = j.copyHalf(dst, src)
+		switch st.Reason {
+		case ReasonEOF:
+			// pass the EOF, or give up like before when can not half-close
+			if !CloseWrite(dst) {
+				j.abort(ReasonClosed)
+			}
+		case ReasonError:
+			j.abort(ReasonClosed)
+		}
+	}
+
+	abDone := make(chan struct{})
+	baDone := make(chan struct{})
+	go run(b, a, &res.AtoB, abDone)
+	if a == b {
+		close(baDone)
+		res.BtoA.Reason = ReasonEOF
+	} else {
+		go run(a, b, &res.BtoA, baDone)
+	}
+
+	var tick <-chan time.Time
+	if idle > 0 {
+		intv := idle / 4
+		if intv < 100*time.Millisecond {
+			intv = 100 * time.Millisecond
+		}
+		t := time.NewTicker(intv)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for abDone != nil || baDone != nil {
+		select {
+		case <-abDone:
+			abDone = nil
+		case <-baDone:
+			baDone = nil
+		case <-tick:
+			last := time.Unix(0, atomic.LoadInt64(&j.last))
+			if time.Since(last) > idle {
+				j.abort(ReasonIdle)
+			}
+		}
+	}
+
+	a.Close()
+	b.Close()
+	return res
+}
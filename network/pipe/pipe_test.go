@@ -0,0 +1,154 @@
+package pipe
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// wrapConn hide *net.TCPConn like a limit or counter wrapper, so Join use the buffered copy
+type wrapConn struct{ net.Conn }
+
+func (c wrapConn) Unwrap() net.Conn { return c.Conn }
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+func TestCloseWrite(t *testing.T) {
+	c1, c2 := tcpPair(t)
+	defer c1.Close()
+	defer c2.Close()
+
+	if !CloseWrite(wrapConn{wrapConn{c1}}) {
+		t.Fatal("CloseWrite through wrappers failed")
+	}
+	if n, err := c2.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("peer read %v, %v, want EOF", n, err)
+	}
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if CloseWrite(wrapConn{p1}) {
+		t.Fatal("CloseWrite on net.Pipe should not support")
+	}
+}
+
+func TestJoinHalfClose(t *testing.T) {
+	a1, a2 := tcpPair(t)
+	b1, b2 := tcpPair(t)
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- Join(wrapConn{a2}, wrapConn{b1}, 0)
+	}()
+
+	// a1 send then half-close, the FIN reach b2, and b2 still can reply
+	go func() {
+		a1.Write([]byte("request"))
+		a1.CloseWrite()
+	}()
+	req, err := ioutil.ReadAll(b2)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("b2 read %q, err %v", req, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := b2.Write([]byte("response")); err != nil {
+		t.Fatalf("b2 write after half-close: %v", err)
+	}
+	b2.Close()
+
+	reply, err := ioutil.ReadAll(a1)
+	if err != nil || string(reply) != "response" {
+		t.Fatalf("a1 read %q, err %v", reply, err)
+	}
+	a1.Close()
+
+	res := <-done
+	if res.AtoB.Bytes != 7 || res.AtoB.Reason != ReasonEOF {
+		t.Fatalf("AtoB = %v", res.AtoB)
+	}
+	if res.BtoA.Bytes != 8 || res.BtoA.Reason != ReasonEOF {
+		t.Fatalf("BtoA = %v", res.BtoA)
+	}
+}
+
+func TestJoinNoHalfClose(t *testing.T) {
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	defer b2.Close()
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- Join(a2, b1, 0)
+	}()
+
+	// net.Pipe can not half-close, EOF close both like before
+	a1.Close()
+	select {
+	case res := <-done:
+		if res.AtoB.Reason != ReasonEOF || res.BtoA.Reason != ReasonClosed {
+			t.Fatalf("AtoB = %v, BtoA = %v", res.AtoB, res.BtoA)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Join not return")
+	}
+}
+
+func TestJoinIdle(t *testing.T) {
+	a1, a2 := tcpPair(t)
+	b1, b2 := tcpPair(t)
+	defer a1.Close()
+	defer b2.Close()
+
+	idle := 300 * time.Millisecond
+	done := make(chan *Result, 1)
+	start := time.Now()
+	go func() {
+		done <- Join(a2, b1, idle)
+	}()
+
+	// traffic keep it alive longer than idle
+	for i := 0; i < 6; i++ {
+		a1.Write([]byte("x"))
+		time.Sleep(idle / 3)
+	}
+	select {
+	case res := <-done:
+		t.Fatalf("closed while active: %v %v", res.AtoB, res.BtoA)
+	default:
+	}
+
+	select {
+	case res := <-done:
+		if res.AtoB.Reason != ReasonIdle || res.BtoA.Reason != ReasonIdle {
+			t.Fatalf("AtoB = %v, BtoA = %v", res.AtoB, res.BtoA)
+		}
+		if res.AtoB.Bytes != 6 {
+			t.Fatalf("AtoB = %v, want 6 bytes", res.AtoB)
+		}
+	case <-time.After(5 * idle):
+		t.Fatalf("not closed after idle, %v passed", time.Since(start))
+	}
+
+	// both ends see the close
+	if _, err := ioutil.ReadAll(a1); err != nil {
+		t.Fatalf("a1 read after idle: %v", err)
+	}
+}
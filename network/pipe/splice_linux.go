@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+package pipe
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+
+	spliceChunk = 64 * 1024 // default pipe capacity
+)
+
+// spliceCopy move data src -> kernel pipe -> dst without copy to user space.
+// ok is false when splice can not be used, nothing is read in that case.
+func spliceCopy(dst, src *net.TCPConn, touch func()) (written int64, ok bool, err error) {
+	var p [2]int
+	if syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK) != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	for {
+		// socket -> pipe
+		var n int64
+		var serr error
+		err = srcRaw.Read(func(fd uintptr) bool {
+			for {
+				n, serr = syscall.Splice(int(fd), nil, p[1], nil, spliceChunk, spliceMove|spliceNonblock)
+				if serr != syscall.EINTR {
+					break
+				}
+			}
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return written, true, err
+		}
+		if n == 0 { // EOF
+			return written, true, nil
+		}
+		touch()
+
+		// pipe -> socket
+		for n > 0 {
+			var m int64
+			err = dstRaw.Write(func(fd uintptr) bool {
+				for {
+					m, serr = syscall.Splice(p[0], nil, int(fd), nil, int(n), spliceMove|spliceNonblock)
+					if serr != syscall.EINTR {
+						break
+					}
+				}
+				return serr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if m > 0 {
+				n -= m
+				written += m
+			}
+			if err != nil {
+				return written, true, err
+			}
+		}
+	}
+}
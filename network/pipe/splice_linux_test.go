@@ -0,0 +1,149 @@
+//go:build linux
+// +build linux
+
+package pipe
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// hide ReadFrom / WriteTo, so io.CopyBuffer really use the buffer
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func listen(b *testing.B) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ln
+}
+
+// client -> forward -> sink over loopback, report throughput and CPU time per op
+func benchForward(b *testing.B, forward func(client, server *net.TCPConn)) {
+	sinkLn := listen(b)
+	defer sinkLn.Close()
+	got := make(chan int64, 1)
+	go func() {
+		c, err := sinkLn.Accept()
+		if err != nil {
+			got <- 0
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, c)
+		c.Close()
+		got <- n
+	}()
+
+	proxyLn := listen(b)
+	defer proxyLn.Close()
+	go func() {
+		c, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		s, err := net.Dial("tcp", sinkLn.Addr().String())
+		if err != nil {
+			c.Close()
+			return
+		}
+		forward(c.(*net.TCPConn), s.(*net.TCPConn))
+	}()
+
+	cli, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Close()
+
+	buf := make([]byte, 64*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	cpu := cpuTime()
+	for i := 0; i < b.N; i++ {
+		if _, err := cli.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	cli.(*net.TCPConn).CloseWrite()
+	n := <-got
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime()-cpu)/float64(b.N), "cpu-ns/op")
+
+	if n != int64(b.N*len(buf)) {
+		b.Fatalf("sink got %v bytes, want %v", n, b.N*len(buf))
+	}
+}
+
+// the old per-tool cp: io.CopyBuffer with a pooled 4 KiB buffer
+func BenchmarkCopyBuffer(b *testing.B) {
+	benchForward(b, func(client, server *net.TCPConn) {
+		buf := make([]byte, 4096)
+		io.CopyBuffer(onlyWriter{server}, onlyReader{client}, buf)
+		server.CloseWrite()
+		client.Close()
+		server.Close()
+	})
+}
+
+func BenchmarkJoinBuffered(b *testing.B) {
+	useSplice = false
+	defer func() { useSplice = true }()
+	benchForward(b, func(client, server *net.TCPConn) {
+		Join(client, server, 0)
+	})
+}
+
+func BenchmarkJoinSplice(b *testing.B) {
+	benchForward(b, func(client, server *net.TCPConn) {
+		Join(client, server, 0)
+	})
+}
+
+func TestSpliceHalfClose(t *testing.T) {
+	a1, a2 := tcpPair(t)
+	b1, b2 := tcpPair(t)
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- Join(a2, b1, 0)
+	}()
+
+	// a1 send then half-close, b2 still can reply after reading all
+	msg := make([]byte, 1<<20)
+	go func() {
+		a1.Write(msg)
+		a1.CloseWrite()
+	}()
+	n, err := io.Copy(ioutil.Discard, b2)
+	if err != nil || n != int64(len(msg)) {
+		t.Fatalf("b2 read %v bytes, err %v", n, err)
+	}
+	b2.Write([]byte("bye"))
+	b2.Close()
+
+	reply, err := ioutil.ReadAll(a1)
+	if err != nil || string(reply) != "bye" {
+		t.Fatalf("a1 read %q, err %v", reply, err)
+	}
+	a1.Close()
+
+	res := <-done
+	if res.AtoB.Bytes != int64(len(msg)) || res.AtoB.Reason != ReasonEOF {
+		t.Fatalf("AtoB = %v", res.AtoB)
+	}
+	if res.BtoA.Bytes != 3 || res.BtoA.Reason != ReasonEOF {
+		t.Fatalf("BtoA = %v", res.BtoA)
+	}
+}
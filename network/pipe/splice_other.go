@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package pipe
+
+import (
+	"net"
+)
+
+// no splice, always use the buffered copy
+func spliceCopy(dst, src *net.TCPConn, touch func()) (written int64, ok bool, err error) {
+	return 0, false, nil
+}
@@ -0,0 +1,173 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseTrusted parse IP or CIDR list spare by ';'
+func ParseTrusted(list string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ipnet)
+	}
+	return out, nil
+}
+
+// Listener require PROXY protocol header from trusted sources,
+// connection without one fail on first Read.
+// Connections from other sources are returned as-is.
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Timeout time.Duration // header read timeout
+}
+
+func NewListener(ln net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{
+		Listener: ln,
+		Trusted:  trusted,
+		Timeout:  5 * time.Second,
+	}
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return NewConn(conn, l.Timeout), nil
+}
+
+// Conn parse the header on first Read or Addr call,
+// so Accept loop not block by slow client.
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once sync.Once
+	hdr  *Header
+	err  error
+
+	dlock sync.Mutex
+	rdl   time.Time // read deadline set by caller, restored after header
+}
+
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:    conn,
+		br:      bufio.NewReader(conn),
+		timeout: timeout,
+	}
+}
+
+func (c *Conn) parse() {
+	if c.timeout > 0 {
+		c.dlock.Lock()
+		dl := time.Now().Add(c.timeout)
+		if !c.rdl.IsZero() && c.rdl.Before(dl) {
+			dl = c.rdl
+		}
+		c.Conn.SetReadDeadline(dl)
+		c.dlock.Unlock()
+		defer func() {
+			c.dlock.Lock()
+			c.Conn.SetReadDeadline(c.rdl)
+			c.dlock.Unlock()
+		}()
+	}
+	// header is a must from trusted source, no guess by peeking
+	c.hdr, c.err = ReadHeader(c.br)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// Header return parsed header, error if client not send a valid one
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.parse)
+	return c.hdr, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.parse)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// SetDeadline and SetReadDeadline keep the read deadline, so header parsing not lose it
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+	c.rdl = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+	c.rdl = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Unwrap return the original connection
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.parse)
+	if c.hdr != nil && c.hdr.Src != nil {
+		return c.hdr.Src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.parse)
+	if c.hdr != nil && c.hdr.Dst != nil {
+		return c.hdr.Dst
+	}
+	return c.Conn.LocalAddr()
+}
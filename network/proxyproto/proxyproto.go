@@ -0,0 +1,242 @@
+// Package proxyproto implement HAProxy PROXY protocol v1 and v2.
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	sigV1 = []byte("PROXY ")
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrBadHeader  = errors.New("proxyproto: bad header")
+	ErrBadVersion = errors.New("proxyproto: unsupported version")
+)
+
+const (
+	maxV1Len = 107
+
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamTCP4 = 0x11
+	v2FamUDP4 = 0x12
+	v2FamTCP6 = 0x21
+	v2FamUDP6 = 0x22
+)
+
+// Header is a parsed PROXY protocol header.
+// Src and Dst are nil for LOCAL command or UNKNOWN protocol.
+type Header struct {
+	Version int
+	Src     net.Addr
+	Dst     net.Addr
+}
+
+// WriteHeader write v1 or v2 header for src -> dst to w.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var b []byte
+	switch version {
+	case 1:
+		b = encodeV1(src, dst)
+	case 2:
+		b = encodeV2(src, dst)
+	default:
+		return ErrBadVersion
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func splitAddr(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+func encodeV1(src, dst net.Addr) []byte {
+	sip, sport, _ := splitAddr(src)
+	dip, dport, _ := splitAddr(dst)
+	if sip == nil || dip == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP6"
+	if sip.To4() != nil && dip.To4() != nil {
+		proto = "TCP4"
+		sip, dip = sip.To4(), dip.To4()
+	} else {
+		sip, dip = sip.To16(), dip.To16()
+	}
+	return []byte("PROXY " + proto + " " + sip.String() + " " + dip.String() + " " + strconv.Itoa(sport) + " " + strconv.Itoa(dport) + "\r\n")
+}
+
+func encodeV2(src, dst net.Addr) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sigV2)
+
+	sip, sport, udp := splitAddr(src)
+	dip, dport, _ := splitAddr(dst)
+	if sip == nil || dip == nil {
+		buf.Write([]byte{v2CmdLocal, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var fam byte
+	var addrs []byte
+	if sip.To4() != nil && dip.To4() != nil {
+		fam = v2FamTCP4
+		addrs = append(addrs, sip.To4()...)
+		addrs = append(addrs, dip.To4()...)
+	} else {
+		fam = v2FamTCP6
+		addrs = append(addrs, sip.To16()...)
+		addrs = append(addrs, dip.To16()...)
+	}
+	if udp {
+		fam++ // v2FamUDP4 or v2FamUDP6
+	}
+	addrs = append(addrs, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+
+	buf.Write([]byte{v2CmdProxy, fam, byte(len(addrs) >> 8), byte(len(addrs))})
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+// ReadHeader read and parse one v1 or v2 header from r, ErrBadHeader if r not start with one.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	// fail at the first byte not in signature, not wait for more
+	for i := 1; i <= len(sigV1); i++ {
+		b, err := r.Peek(i)
+		if err == io.EOF && i > 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(sigV1, b) && !bytes.HasPrefix(sigV2, b) {
+			return nil, ErrBadHeader
+		}
+	}
+	b, _ := r.Peek(len(sigV1))
+	if bytes.Equal(b, sigV1) {
+		return readV1(r)
+	}
+
+	b, err := r.Peek(len(sigV2))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, sigV2) {
+		return readV2(r)
+	}
+	return nil, ErrBadHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= maxV1Len {
+			return nil, ErrBadHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrBadHeader
+	}
+
+	hdr := &Header{Version: 1}
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return hdr, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, ErrBadHeader
+	}
+
+	sip := net.ParseIP(parts[2])
+	dip := net.ParseIP(parts[3])
+	sport, err1 := strconv.ParseUint(parts[4], 10, 16)
+	dport, err2 := strconv.ParseUint(parts[5], 10, 16)
+	if sip == nil || dip == nil || err1 != nil || err2 != nil {
+		return nil, ErrBadHeader
+	}
+	hdr.Src = &net.TCPAddr{IP: sip, Port: int(sport)}
+	hdr.Dst = &net.TCPAddr{IP: dip, Port: int(dport)}
+	return hdr, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]&0xF0 != 0x20 {
+		return nil, ErrBadVersion
+	}
+	size := int(binary.BigEndian.Uint16(fixed[14:16]))
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	hdr := &Header{Version: 2}
+	switch fixed[12] {
+	case v2CmdLocal:
+		return hdr, nil
+	case v2CmdProxy:
+	default:
+		return nil, ErrBadHeader
+	}
+
+	var iplen int
+	udp := false
+	switch fixed[13] {
+	case v2FamTCP4:
+		iplen = net.IPv4len
+	case v2FamUDP4:
+		iplen, udp = net.IPv4len, true
+	case v2FamTCP6:
+		iplen = net.IPv6len
+	case v2FamUDP6:
+		iplen, udp = net.IPv6len, true
+	default:
+		// AF_UNIX or UNSPEC, ignore the address
+		return hdr, nil
+	}
+	if size < iplen*2+4 {
+		return nil, ErrBadHeader
+	}
+
+	sip := net.IP(body[0:iplen])
+	dip := net.IP(body[iplen : iplen*2])
+	sport := int(binary.BigEndian.Uint16(body[iplen*2:]))
+	dport := int(binary.BigEndian.Uint16(body[iplen*2+2:]))
+	if udp {
+		hdr.Src = &net.UDPAddr{IP: sip, Port: sport}
+		hdr.Dst = &net.UDPAddr{IP: dip, Port: dport}
+	} else {
+		hdr.Src = &net.TCPAddr{IP: sip, Port: sport}
+		hdr.Dst = &net.TCPAddr{IP: dip, Port: dport}
+	}
+	return hdr, nil
+}
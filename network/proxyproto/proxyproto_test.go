@@ -0,0 +1,217 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2(cmd byte, fam byte, body []byte) []byte {
+	b := append([]byte{}, sigV2...)
+	b = append(b, cmd, fam, byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+var (
+	tcp4Src = &net.TCPAddr{IP: net.ParseIP("192.168.0.1").To4(), Port: 56324}
+	tcp4Dst = &net.TCPAddr{IP: net.ParseIP("192.168.0.11").To4(), Port: 443}
+	tcp6Src = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	tcp6Dst = &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+	udp4Src = &net.UDPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 53}
+	udp4Dst = &net.UDPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 5353}
+)
+
+var headerTests = []struct {
+	name string
+	in   []byte
+	ver  int
+	src  net.Addr
+	dst  net.Addr
+}{
+	{"v1 tcp4", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), 1, tcp4Src, tcp4Dst},
+	{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\n"), 1, tcp6Src, tcp6Dst},
+	{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), 1, nil, nil},
+	{"v1 unknown with addr", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), 1, nil, nil},
+	{"v2 tcp4", v2(v2CmdProxy, v2FamTCP4, []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb}), 2, tcp4Src, tcp4Dst},
+	{"v2 tcp6", encodeV2(tcp6Src, tcp6Dst), 2, tcp6Src, tcp6Dst},
+	{"v2 udp4", encodeV2(udp4Src, udp4Dst), 2, udp4Src, udp4Dst},
+	{"v2 tcp4 with TLV", v2(v2CmdProxy, v2FamTCP4, []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb, 0x04, 0x00, 0x01, 0xff}), 2, tcp4Src, tcp4Dst},
+	{"v2 local", v2(v2CmdLocal, 0x00, nil), 2, nil, nil},
+	{"v2 local with addr", v2(v2CmdLocal, v2FamTCP4, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 1, 0, 2}), 2, nil, nil},
+	{"v2 unspec", v2(v2CmdProxy, 0x00, nil), 2, nil, nil},
+	{"v2 unix", v2(v2CmdProxy, 0x31, make([]byte, 216)), 2, nil, nil},
+}
+
+func sameAddr(a net.Addr, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+func TestReadHeader(t *testing.T) {
+	tail := []byte("GET / HTTP/1.0\r\n")
+	for _, tt := range headerTests {
+		r := bufio.NewReader(bytes.NewReader(append(append([]byte{}, tt.in...), tail...)))
+		hdr, err := ReadHeader(r)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if hdr.Version != tt.ver || !sameAddr(hdr.Src, tt.src) || !sameAddr(hdr.Dst, tt.dst) {
+			t.Errorf("%v: got v%v %v -> %v, want v%v %v -> %v", tt.name, hdr.Version, hdr.Src, hdr.Dst, tt.ver, tt.src, tt.dst)
+		}
+		rest, _ := io.ReadAll(r)
+		if !bytes.Equal(rest, tail) {
+			t.Errorf("%v: read past header, rest %q", tt.name, rest)
+		}
+	}
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	for _, tt := range headerTests {
+		for i := 0; i < len(tt.in); i++ {
+			if _, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.in[:i]))); err == nil {
+				t.Errorf("%v cut at %v: no error", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestReadHeaderBad(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), ErrBadHeader},
+		{"SOCKS5 greeting", []byte{5, 1, 0}, ErrBadHeader},
+		{"lower case", []byte("proxy TCP4 1.2.3.4 5.6.7.8 1 2\r\n"), ErrBadHeader},
+		{"v1 too long", []byte("PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"), ErrBadHeader},
+		{"v1 no CR", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n"), ErrBadHeader},
+		{"v1 bad proto", []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n"), ErrBadHeader},
+		{"v1 missing field", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"), ErrBadHeader},
+		{"v1 extra field", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 2 3\r\n"), ErrBadHeader},
+		{"v1 bad IP", []byte("PROXY TCP4 1.2.3.400 5.6.7.8 1 2\r\n"), ErrBadHeader},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 65536\r\n"), ErrBadHeader},
+		{"v1 negative port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 -1 2\r\n"), ErrBadHeader},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), ErrBadHeader},
+		{"v2 version 1", v2(0x11, v2FamTCP4, make([]byte, 12)), ErrBadVersion},
+		{"v2 bad command", v2(0x22, v2FamTCP4, make([]byte, 12)), ErrBadHeader},
+		{"v2 short tcp4", v2(v2CmdProxy, v2FamTCP4, make([]byte, 11)), ErrBadHeader},
+		{"v2 short tcp6", v2(v2CmdProxy, v2FamTCP6, make([]byte, 35)), ErrBadHeader},
+	}
+	for _, tt := range tests {
+		if _, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.in))); err != tt.want {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// length field larger than sent
+	in := v2(v2CmdProxy, v2FamTCP4, make([]byte, 12))
+	in[15] = 0xff
+	if _, err := ReadHeader(bufio.NewReader(bytes.NewReader(in))); err == nil {
+		t.Errorf("v2 oversized length: no error")
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		wantSrc  net.Addr
+	}{
+		{"tcp4", tcp4Src, tcp4Dst, tcp4Src},
+		{"tcp6", tcp6Src, tcp6Dst, tcp6Src},
+		{"4 in 6", &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}, tcp4Dst, tcp4Src},
+		{"unknown", &net.UnixAddr{Name: "/tmp/x", Net: "unix"}, tcp4Dst, nil},
+	}
+	for _, tt := range tests {
+		for ver := 1; ver <= 2; ver++ {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, ver, tt.src, tt.dst); err != nil {
+				t.Fatalf("%v v%v: %v", tt.name, ver, err)
+			}
+			hdr, err := ReadHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("%v v%v: read back %q: %v", tt.name, ver, buf.Bytes(), err)
+			}
+			if hdr.Version != ver || !sameAddr(hdr.Src, tt.wantSrc) {
+				t.Errorf("%v v%v: got v%v %v, want %v", tt.name, ver, hdr.Version, hdr.Src, tt.wantSrc)
+			}
+		}
+	}
+	if err := WriteHeader(io.Discard, 3, tcp4Src, tcp4Dst); err != ErrBadVersion {
+		t.Errorf("version 3 err = %v", err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go c2.Write(append([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), "hello"...))
+
+	c := NewConn(c1, time.Second)
+	if !sameAddr(c.RemoteAddr(), tcp4Src) || !sameAddr(c.LocalAddr(), tcp4Dst) {
+		t.Fatalf("addr %v -> %v", c.RemoteAddr(), c.LocalAddr())
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q %v", buf, err)
+	}
+}
+
+func TestConnNoHeader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go c2.Write([]byte("SSH-2.0-x\r\n"))
+
+	c := NewConn(c1, time.Second)
+	if _, err := c.Read(make([]byte, 16)); err != ErrBadHeader {
+		t.Fatalf("read err = %v", err)
+	}
+	if _, err := c.Header(); err != ErrBadHeader {
+		t.Fatalf("header err = %v", err)
+	}
+	// the real address is still there for log
+	if c.RemoteAddr() != c1.RemoteAddr() {
+		t.Fatalf("remote addr %v", c.RemoteAddr())
+	}
+}
+
+func TestConnTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := NewConn(c1, 50*time.Millisecond)
+	_, err := c.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read err = %v, want timeout", err)
+	}
+}
+
+// deadline set before the first Read still work, the header parse not clear it
+func TestConnCallerDeadline(t *testing.T) {
+	for _, withHeader := range []bool{true, false} {
+		c1, c2 := net.Pipe()
+		if withHeader {
+			go c2.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+		}
+
+		c := NewConn(c1, 5*time.Second)
+		c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		start := time.Now()
+		_, err := c.Read(make([]byte, 16))
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("header %v: read err = %v, want timeout", withHeader, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("header %v: caller deadline ignored, read took %v", withHeader, d)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
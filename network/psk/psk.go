@@ -0,0 +1,389 @@
+// Package psk is an encrypted transport keyed from a pre-shared key, no certificate needed.
+//
+// The master key is derived from the PSK by scrypt, so a captured handshake is slow to brute force.
+// Handshake, all MAC are HMAC-SHA256 by the master key:
+//
+//	client -> server: nonceC(32) time(8) MAC("client", nonceC, time)
+//	server -> client: nonceS(32) MAC("server", nonceC, nonceS)
+//
+// The server drop client hello with bad MAC, old time, or seen nonce (replay),
+// then each direction use AES-256-GCM with its own key derived from both nonces.
+// A record is the sealed 2 bytes length followed by the sealed payload,
+// the nonce is an implicit counter, so replayed, reordered or dropped records fail.
+// A zero length record means EOF, so a forged TCP FIN can not truncate the stream.
+package psk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	nonceSize  = 32
+	macSize    = sha256.Size
+	helloSize  = nonceSize + 8 + macSize
+	replySize  = nonceSize + macSize
+	overhead   = 16 // GCM tag
+	maxPayload = 16*1024 - 1
+
+	// DefaultMaxSkew is the allowed clock difference between both sides
+	DefaultMaxSkew = 2 * time.Minute
+
+	// scrypt cost, about 32 MiB and tens of ms, only once per key
+	kdfN = 1 << 15
+	kdfR = 8
+	kdfP = 1
+)
+
+// fixed salt, both sides derive the same key from the PSK only
+var kdfSalt = []byte("go-smalltools psk v1")
+
+var (
+	ErrAuth      = errors.New("psk: authentication failed")
+	ErrReplay    = errors.New("psk: replayed handshake")
+	ErrClockSkew = errors.New("psk: clock skew too large")
+)
+
+// Key hold the master key and the seen client nonce for replay protection
+type Key struct {
+	// MaxSkew is the allowed clock difference of client hello, checked by server side,
+	// both sides need a synced clock, seen nonce are kept for 2 times of it
+	MaxSkew time.Duration
+
+	master []byte
+
+	lock  sync.Mutex
+	seen  map[[nonceSize]byte]bool
+	queue []seenNonce // in time order, for expiring seen
+}
+
+type seenNonce struct {
+	nonce [nonceSize]byte
+	t     time.Time
+}
+
+func NewKey(psk string) *Key {
+	master, err := scrypt.Key([]byte(psk), kdfSalt, kdfN, kdfR, kdfP, sha256.Size)
+	if err != nil {
+		// only by bad parameters
+		panic(err)
+	}
+	return &Key{
+		MaxSkew: DefaultMaxSkew,
+		master:  master,
+		seen:    make(map[[nonceSize]byte]bool),
+	}
+}
+
+func (k *Key) mac(label string, parts ...[]byte) []byte {
+	m := hmac.New(sha256.New, k.master)
+	m.Write([]byte(label))
+	for _, p := range parts {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+// checkReplay remember nonce until it is too old to pass the time check
+func (k *Key) checkReplay(nonce []byte, now time.Time) error {
+	var n [nonceSize]byte
+	copy(n[:], nonce)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	i := 0
+	for ; i < len(k.queue) && now.Sub(k.queue[i].t) > 2*k.MaxSkew; i++ {
+		delete(k.seen, k.queue[i].nonce)
+	}
+	k.queue = k.queue[i:]
+
+	if k.seen[n] {
+		return ErrReplay
+	}
+	k.seen[n] = true
+	k.queue = append(k.queue, seenNonce{n, now})
+	return nil
+}
+
+// Client wrap the dialing side, handshake on first Read / Write or by Handshake
+func (k *Key) Client(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, key: k, client: true}
+}
+
+// Server wrap the accepting side
+func (k *Key) Server(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, key: k}
+}
+
+type Listener struct {
+	net.Listener
+	Key *Key
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.Key.Server(conn), nil
+}
+
+type Conn struct {
+	net.Conn
+	key    *Key
+	client bool
+
+	hsOnce sync.Once
+	hsErr  error
+
+	rlock   sync.Mutex
+	rAEAD   cipher.AEAD
+	rNonce  [12]byte
+	rBuf    []byte // decrypted, not read yet
+	rEOF    bool
+	rRecord []byte
+
+	wlock  sync.Mutex
+	wAEAD  cipher.AEAD
+	wNonce [12]byte
+	wEOF   bool
+}
+
+// Handshake run once, safe to call many times
+func (c *Conn) Handshake() error {
+	c.hsOnce.Do(func() {
+		if c.client {
+			c.hsErr = c.clientHandshake()
+		} else {
+			c.hsErr = c.serverHandshake()
+		}
+	})
+	return c.hsErr
+}
+
+func (c *Conn) clientHandshake() error {
+	hello := make([]byte, helloSize)
+	nonceC := hello[:nonceSize]
+	if _, err := rand.Read(nonceC); err != nil {
+		return err
+	}
+	ts := hello[nonceSize : nonceSize+8]
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+	copy(hello[nonceSize+8:], c.key.mac("client", nonceC, ts))
+	if _, err := c.Conn.Write(hello); err != nil {
+		return err
+	}
+
+	reply := make([]byte, replySize)
+	if _, err := io.ReadFull(c.Conn, reply); err != nil {
+		return err
+	}
+	nonceS := reply[:nonceSize]
+	if !hmac.Equal(reply[nonceSize:], c.key.mac("server", nonceC, nonceS)) {
+		return ErrAuth
+	}
+	return c.setKeys(nonceC, nonceS)
+}
+
+func (c *Conn) serverHandshake() error {
+	hello := make([]byte, helloSize)
+	if _, err := io.ReadFull(c.Conn, hello); err != nil {
+		return err
+	}
+	nonceC := hello[:nonceSize]
+	ts := hello[nonceSize : nonceSize+8]
+	if !hmac.Equal(hello[nonceSize+8:], c.key.mac("client", nonceC, ts)) {
+		return ErrAuth
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(int64(binary.BigEndian.Uint64(ts)), 0))
+	if skew > c.key.MaxSkew || skew < -c.key.MaxSkew {
+		return ErrClockSkew
+	}
+	if err := c.key.checkReplay(nonceC, now); err != nil {
+		return err
+	}
+
+	reply := make([]byte, replySize)
+	nonceS := reply[:nonceSize]
+	if _, err := rand.Read(nonceS); err != nil {
+		return err
+	}
+	copy(reply[nonceSize:], c.key.mac("server", nonceC, nonceS))
+	if _, err := c.Conn.Write(reply); err != nil {
+		return err
+	}
+	return c.setKeys(nonceC, nonceS)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *Conn) setKeys(nonceC, nonceS []byte) error {
+	c2s, err := newAEAD(c.key.mac("c2s", nonceC, nonceS))
+	if err != nil {
+		return err
+	}
+	s2c, err := newAEAD(c.key.mac("s2c", nonceC, nonceS))
+	if err != nil {
+		return err
+	}
+	if c.client {
+		c.wAEAD, c.rAEAD = c2s, s2c
+	} else {
+		c.wAEAD, c.rAEAD = s2c, c2s
+	}
+	return nil
+}
+
+func incNonce(n *[12]byte) {
+	for i := range n {
+		n[i]++
+		if n[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.wEOF {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if err := c.writeRecord(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// caller hold wlock
+func (c *Conn) writeRecord(p []byte) error {
+	buf := make([]byte, 0, 2+overhead+len(p)+overhead)
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(p)))
+	buf = c.wAEAD.Seal(buf, c.wNonce[:], l[:], nil)
+	incNonce(&c.wNonce)
+	if len(p) > 0 {
+		buf = c.wAEAD.Seal(buf, c.wNonce[:], p, nil)
+		incNonce(&c.wNonce)
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	for len(c.rBuf) == 0 {
+		if c.rEOF {
+			return 0, io.EOF
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rBuf)
+	c.rBuf = c.rBuf[n:]
+	return n, nil
+}
+
+// caller hold rlock
+func (c *Conn) readRecord() error {
+	if c.rRecord == nil {
+		c.rRecord = make([]byte, maxPayload+overhead)
+	}
+	hdr := c.rRecord[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, hdr); err != nil {
+		if err == io.EOF {
+			// EOF without the EOF record
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	l, err := c.rAEAD.Open(hdr[:0], c.rNonce[:], hdr, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	incNonce(&c.rNonce)
+	n := int(binary.BigEndian.Uint16(l))
+	if n == 0 {
+		c.rEOF = true
+		return nil
+	}
+	if n > maxPayload {
+		return ErrAuth
+	}
+
+	rec := c.rRecord[:n+overhead]
+	if _, err := io.ReadFull(c.Conn, rec); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	c.rBuf, err = c.rAEAD.Open(rec[:0], c.rNonce[:], rec, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	incNonce(&c.rNonce)
+	return nil
+}
+
+// CloseWrite send the EOF record then half-close the underlying connection
+func (c *Conn) CloseWrite() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.wEOF {
+		return nil
+	}
+	c.wEOF = true
+	if err := c.writeRecord(nil); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Unwrap return the original connection
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
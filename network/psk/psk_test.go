@@ -0,0 +1,256 @@
+package psk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapConn record what is written, and flip one byte of a Write when armed
+type tapConn struct {
+	net.Conn
+	lock sync.Mutex
+	sent bytes.Buffer
+	flip int // offset in next Write, < 0 disable
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.sent.Write(b)
+	if c.flip >= 0 && c.flip < len(b) {
+		b = append([]byte{}, b...)
+		b[c.flip] ^= 0x80
+		c.flip = -1
+	}
+	c.lock.Unlock()
+	return c.Conn.Write(b)
+}
+
+func pair(t *testing.T, ck *Key, sk *Key) (*Conn, *Conn, *tapConn) {
+	c1, c2 := net.Pipe()
+	tap := &tapConn{Conn: c1, flip: -1}
+	cli, srv := ck.Client(tap), sk.Server(c2)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return cli, srv, tap
+}
+
+func handshake(cli *Conn, srv *Conn) (error, error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Handshake()
+	}()
+	errC := cli.Handshake()
+	return errC, <-done
+}
+
+var masters sync.Map // psk -> master key, scrypt is slow under -race
+
+// newKey is NewKey with the derived master key cached
+func newKey(psk string) *Key {
+	if m, ok := masters.Load(psk); ok {
+		return &Key{MaxSkew: DefaultMaxSkew, master: m.([]byte), seen: make(map[[nonceSize]byte]bool)}
+	}
+	k := NewKey(psk)
+	masters.Store(psk, k.master)
+	return k
+}
+
+// hello craft a client hello at the given time
+func hello(k *Key, ts time.Time) []byte {
+	b := make([]byte, helloSize)
+	binary.BigEndian.PutUint64(b[nonceSize:], uint64(ts.Unix()))
+	copy(b[nonceSize+8:], k.mac("client", b[:nonceSize], b[nonceSize:nonceSize+8]))
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := newKey("secret")
+	cli, srv, _ := pair(t, k, k)
+
+	// larger than one record
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	go func() {
+		cli.Write(data)
+		cli.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(srv)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("server read %v bytes, err %v", len(got), err)
+	}
+	if _, err := cli.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after CloseWrite err = %v", err)
+	}
+
+	// other direction still open
+	go func() {
+		srv.Write([]byte("pong"))
+		srv.CloseWrite()
+	}()
+	got, err = ioutil.ReadAll(cli)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("client read %q %v", got, err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	k := newKey("secret")
+	for _, off := range []int{0, 2 + overhead, 2 + overhead + 3} {
+		cli, srv, tap := pair(t, k, k)
+		if errC, errS := handshake(cli, srv); errC != nil || errS != nil {
+			t.Fatalf("handshake %v / %v", errC, errS)
+		}
+
+		tap.lock.Lock()
+		tap.flip = off
+		tap.lock.Unlock()
+		go cli.Write([]byte("hello"))
+		if _, err := srv.Read(make([]byte, 16)); err != ErrAuth {
+			t.Fatalf("flip at %v: read err = %v, want %v", off, err, ErrAuth)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	k := newKey("secret")
+	cli, srv, _ := pair(t, k, k)
+	if errC, errS := handshake(cli, srv); errC != nil || errS != nil {
+		t.Fatalf("handshake %v / %v", errC, errS)
+	}
+
+	// connection closed without the EOF record
+	go func() {
+		cli.Write([]byte("partial"))
+		cli.Unwrap().Close()
+	}()
+	got, err := ioutil.ReadAll(srv)
+	if err != io.ErrUnexpectedEOF || string(got) != "partial" {
+		t.Fatalf("read %q, err = %v, want %v", got, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	cli, srv, _ := pair(t, newKey("secret"), newKey("other"))
+	done := make(chan error, 1)
+	go func() {
+		err := srv.Handshake()
+		srv.Unwrap().Close()
+		done <- err
+	}()
+	if err := cli.Handshake(); err == nil {
+		t.Fatal("client handshake success with wrong key")
+	}
+	if err := <-done; err != ErrAuth {
+		t.Fatalf("server err = %v, want %v", err, ErrAuth)
+	}
+
+	// fake server without the key
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		io.ReadFull(c2, make([]byte, helloSize))
+		c2.Write(make([]byte, replySize))
+	}()
+	if err := newKey("secret").Client(c1).Handshake(); err != ErrAuth {
+		t.Fatalf("client err = %v, want %v", err, ErrAuth)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	k := newKey("secret")
+	cli, srv, tap := pair(t, k, k)
+	if errC, errS := handshake(cli, srv); errC != nil || errS != nil {
+		t.Fatalf("handshake %v / %v", errC, errS)
+	}
+	tap.lock.Lock()
+	captured := append([]byte{}, tap.sent.Bytes()[:helloSize]...)
+	tap.lock.Unlock()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c1.Write(captured)
+	if err := k.Server(c2).Handshake(); err != ErrReplay {
+		t.Fatalf("replayed hello err = %v, want %v", err, ErrReplay)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		skew time.Duration
+		ts   time.Time
+		want error
+	}{
+		{"now", DefaultMaxSkew, now, nil},
+		{"slow in window", DefaultMaxSkew, now.Add(-time.Minute), nil},
+		{"fast in window", DefaultMaxSkew, now.Add(time.Minute), nil},
+		{"too old", DefaultMaxSkew, now.Add(-3 * time.Minute), ErrClockSkew},
+		{"too new", DefaultMaxSkew, now.Add(3 * time.Minute), ErrClockSkew},
+		{"no RTC", DefaultMaxSkew, time.Unix(0, 0), ErrClockSkew},
+		{"raised skew", time.Hour, now.Add(-30 * time.Minute), nil},
+	}
+	for _, tt := range tests {
+		k := newKey("secret")
+		k.MaxSkew = tt.skew
+
+		c1, c2 := net.Pipe()
+		go io.Copy(ioutil.Discard, c1)
+		go c1.Write(hello(k, tt.ts))
+		if err := k.Server(c2).Handshake(); err != tt.want {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, tt.want)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestReplayExpire(t *testing.T) {
+	k := newKey("secret")
+	now := time.Now()
+	nonce := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, nonceSize)
+	}
+
+	tests := []struct {
+		name  string
+		nonce byte
+		at    time.Duration
+		want  error
+		kept  int // seen after check
+	}{
+		{"first", 1, 0, nil, 1},
+		{"second", 2, time.Minute, nil, 2},
+		{"replay", 1, 2 * time.Minute, ErrReplay, 2},
+		{"first expired", 3, 4*time.Minute + time.Second, nil, 2},
+		{"old nonce again", 1, 4*time.Minute + 2*time.Second, nil, 3},
+		{"all expired", 4, 10 * time.Minute, nil, 1},
+	}
+	for _, tt := range tests {
+		if err := k.checkReplay(nonce(tt.nonce), now.Add(tt.at)); err != tt.want {
+			t.Fatalf("%v: err = %v, want %v", tt.name, err, tt.want)
+		}
+		if len(k.seen) != tt.kept || len(k.queue) != tt.kept {
+			t.Fatalf("%v: kept %v / %v, want %v", tt.name, len(k.seen), len(k.queue), tt.kept)
+		}
+	}
+}
+
+func TestKDF(t *testing.T) {
+	a, b := NewKey("secret"), newKey("secret")
+	if !bytes.Equal(a.master, b.master) || len(a.master) != 32 {
+		t.Fatalf("master %x / %x", a.master, b.master)
+	}
+	if bytes.Equal(a.master, NewKey("Secret").master) {
+		t.Fatal("different PSK same master")
+	}
+}
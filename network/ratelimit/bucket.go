@@ -0,0 +1,173 @@
+// Package ratelimit is a goroutine-safe hierarchical token bucket limiter.
+//
+// A Bucket may have a parent, taking n tokens from a bucket also take n tokens
+// from all its parents, so per-connection buckets under a per-user bucket under
+// a global bucket share the upper limits.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is replaceable for testing
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the default clock
+var SystemClock Clock = realClock{}
+
+type Bucket struct {
+	parent *Bucket
+	clock  Clock
+
+	lock   sync.Mutex
+	rate   float64 // tokens (bytes) per second, <= 0 no limit
+	burst  float64
+	tokens float64 // can be negative, means debt to wait
+	last   time.Time
+
+	children map[string]*Bucket
+}
+
+// NewBucket create a bucket, rate <= 0 means no limit on this level,
+// burst <= 0 means one second of rate.
+func NewBucket(rate int, burst int, parent *Bucket) *Bucket {
+	clock := SystemClock
+	if parent != nil {
+		clock = parent.clock
+	}
+	return NewBucketWithClock(rate, burst, parent, clock)
+}
+
+func NewBucketWithClock(rate int, burst int, parent *Bucket, clock Clock) *Bucket {
+	b := &Bucket{
+		parent: parent,
+		clock:  clock,
+		last:   clock.Now(),
+	}
+	b.setRate(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *Bucket) setRate(rate int, burst int) {
+	b.rate = float64(rate)
+	if burst <= 0 {
+		burst = rate
+	}
+	b.burst = float64(burst)
+}
+
+// SetRate change rate and burst at runtime, take effect for next wait
+func (b *Bucket) SetRate(rate int, burst int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(b.clock.Now())
+	b.setRate(rate, burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Rate return current rate, <= 0 means no limit
+func (b *Bucket) Rate() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return int(b.rate)
+}
+
+func (b *Bucket) Parent() *Bucket {
+	return b.parent
+}
+
+// Child return a named child bucket, create with rate and burst if not exist.
+// Useful for per-user bucket under a global bucket.
+func (b *Bucket) Child(name string, rate int, burst int) *Bucket {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.children == nil {
+		b.children = make(map[string]*Bucket)
+	}
+	c, ok := b.children[name]
+	if !ok {
+		c = NewBucketWithClock(rate, burst, b, b.clock)
+		b.children[name] = c
+	}
+	return c
+}
+
+// Limited check any level has a limit
+func (b *Bucket) Limited() bool {
+	for l := b; l != nil; l = l.parent {
+		if l.Rate() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		b.last = now
+		return
+	}
+	dt := now.Sub(b.last).Seconds()
+	if dt > 0 {
+		b.tokens += dt * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take n tokens, return how long to wait until the debt is paid
+func (b *Bucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.clock.Now()
+	b.refill(now)
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Reserve take n tokens from this bucket and all parents,
+// return the time to wait before using them.
+func (b *Bucket) Reserve(n int) time.Duration {
+	var wait time.Duration
+	for l := b; l != nil; l = l.parent {
+		if w := l.take(n); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Wait take n tokens and block until allowed, return false if cancel closed
+func (b *Bucket) Wait(n int, cancel <-chan struct{}) bool {
+	wait := b.Reserve(n)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-cancel:
+		return false
+	case <-b.clock.After(wait):
+		return true
+	}
+}
@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock jump forward on every After, so tests run instantly
+// and the elapsed time is exactly the time the limiter asked to wait.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// throughput in byte/sec after sending total bytes by chunk
+func measure(t *testing.T, clk *fakeClock, b *Bucket, total int, chunk int) float64 {
+	start := clk.Now()
+	for sent := 0; sent < total; sent += chunk {
+		if !b.Wait(chunk, nil) {
+			t.Fatal("wait canceled")
+		}
+	}
+	return float64(total) / clk.Since(start).Seconds()
+}
+
+func within(got float64, want float64, tolerance float64) bool {
+	return got >= want*(1-tolerance) && got <= want*(1+tolerance)
+}
+
+func TestBucketThroughput(t *testing.T) {
+	clk := newFakeClock()
+	b := NewBucketWithClock(100*1024, 4096, nil, clk)
+
+	got := measure(t, clk, b, 10*1024*1024, 1024)
+	if !within(got, 100*1024, 0.01) {
+		t.Fatalf("throughput = %.0f, want about %d", got, 100*1024)
+	}
+}
+
+func TestBucketBurst(t *testing.T) {
+	clk := newFakeClock()
+	b := NewBucketWithClock(1000, 5000, nil, clk)
+
+	// full bucket, no wait
+	if w := b.Reserve(5000); w != 0 {
+		t.Fatalf("first burst wait = %v, want 0", w)
+	}
+	// empty bucket, wait for 1000 tokens
+	if w := b.Reserve(1000); w != time.Second {
+		t.Fatalf("after burst wait = %v, want 1s", w)
+	}
+
+	// idle long time only refill up to burst
+	clk.Advance(time.Hour)
+	if w := b.Reserve(5000); w != 0 {
+		t.Fatalf("refill wait = %v, want 0", w)
+	}
+	if w := b.Reserve(1); w <= 0 {
+		t.Fatalf("over burst wait = %v, want > 0", w)
+	}
+}
+
+func TestBucketUnlimited(t *testing.T) {
+	clk := newFakeClock()
+	b := NewBucketWithClock(0, 0, nil, clk)
+	for i := 0; i < 1000; i++ {
+		if w := b.Reserve(1 << 20); w != 0 {
+			t.Fatalf("unlimited wait = %v", w)
+		}
+	}
+	if b.Limited() {
+		t.Fatal("unlimited bucket report limited")
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	clk := newFakeClock()
+	b := NewBucketWithClock(10*1024, 1024, nil, clk)
+	got := measure(t, clk, b, 1024*1024, 512)
+	if !within(got, 10*1024, 0.01) {
+		t.Fatalf("before SetRate throughput = %.0f", got)
+	}
+
+	b.SetRate(50*1024, 1024)
+	got = measure(t, clk, b, 5*1024*1024, 512)
+	if !within(got, 50*1024, 0.01) {
+		t.Fatalf("after SetRate throughput = %.0f, want about %d", got, 50*1024)
+	}
+	if b.Rate() != 50*1024 {
+		t.Fatalf("Rate() = %v", b.Rate())
+	}
+}
+
+// two connections under one user under a global limit,
+// the slowest level decide the total throughput
+func TestBucketHierarchy(t *testing.T) {
+	clk := newFakeClock()
+	global := NewBucketWithClock(100*1024, 4096, nil, clk)
+	user := global.Child("alice", 60*1024, 4096)
+	if global.Child("alice", 1, 1) != user {
+		t.Fatal("Child not reuse the same bucket")
+	}
+	c1 := NewBucket(40*1024, 4096, user)
+	c2 := NewBucket(40*1024, 4096, user)
+
+	// each conn alone is limited by itself
+	got := measure(t, clk, c1, 4*1024*1024, 1024)
+	if !within(got, 40*1024, 0.02) {
+		t.Fatalf("single conn throughput = %.0f, want about %d", got, 40*1024)
+	}
+
+	// two conns together are limited by the user bucket
+	start := clk.Now()
+	total := 8 * 1024 * 1024
+	for sent := 0; sent < total; sent += 2048 {
+		c1.Wait(1024, nil)
+		c2.Wait(1024, nil)
+	}
+	got = float64(total) / clk.Since(start).Seconds()
+	if !within(got, 60*1024, 0.02) {
+		t.Fatalf("two conns throughput = %.0f, want about %d", got, 60*1024)
+	}
+
+	// user under a smaller global
+	global.SetRate(30*1024, 4096)
+	got = measure(t, clk, c1, 4*1024*1024, 1024)
+	if !within(got, 30*1024, 0.02) {
+		t.Fatalf("global limited throughput = %.0f, want about %d", got, 30*1024)
+	}
+}
+
+func TestBucketCancel(t *testing.T) {
+	b := NewBucket(1, 1, nil)
+	b.Reserve(1)
+
+	die := make(chan struct{})
+	close(die)
+	if b.Wait(1000, die) {
+		t.Fatal("Wait should return false when canceled")
+	}
+}
+
+func TestBucketConcurrent(t *testing.T) {
+	b := NewBucket(1<<30, 0, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				b.Wait(100, nil)
+				if j%100 == 0 {
+					b.SetRate(1<<30+i, 0)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConnWrite(t *testing.T) {
+	clk := newFakeClock()
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := p2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := NewConn(p1, nil, NewBucketWithClock(64*1024, 4096, nil, clk))
+	defer c.Close()
+
+	start := clk.Now()
+	buf := make([]byte, 1024)
+	total := 2 * 1024 * 1024
+	for sent := 0; sent < total; sent += len(buf) {
+		if _, err := c.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := float64(total) / clk.Since(start).Seconds()
+	if !within(got, 64*1024, 0.01) {
+		t.Fatalf("conn write throughput = %.0f, want about %d", got, 64*1024)
+	}
+	if _, tx := c.Stat(); tx != int64(total) {
+		t.Fatalf("Stat tx = %v, want %v", tx, total)
+	}
+}
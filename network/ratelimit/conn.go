@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// max bytes read at once when limited, so a big read can not overdraw too much
+const maxReadChunk = 16 * 1024
+
+var ErrClosed = errors.New("ratelimit: connection closed")
+
+// Conn limit read (RX) and write (TX) speed of a net.Conn
+// and count the bytes in both directions.
+type Conn struct {
+	net.Conn
+	rx *Bucket
+	tx *Bucket
+
+	rxBytes int64
+	txBytes int64
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewConn wrap conn, rx and tx should be per-connection buckets (can have parents).
+// nil bucket means no limit.
+func NewConn(conn net.Conn, rx *Bucket, tx *Bucket) *Conn {
+	if rx == nil {
+		rx = NewBucket(0, 0, nil)
+	}
+	if tx == nil {
+		tx = NewBucket(0, 0, nil)
+	}
+	return &Conn{
+		Conn: conn,
+		rx:   rx,
+		tx:   tx,
+		die:  make(chan struct{}),
+	}
+}
+
+// Read wait after the data arrived, read size is bounded so the debt is small.
+// Waiting before would hold tokens of shared parents while the peer is idle.
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) > maxReadChunk && c.rx.Limited() {
+		b = b[:maxReadChunk]
+	}
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.rxBytes, int64(n))
+	if n > 0 && !c.rx.Wait(n, c.die) && err == nil {
+		err = ErrClosed
+	}
+	return n, err
+}
+
+// Write wait for tokens before sending
+func (c *Conn) Write(b []byte) (int, error) {
+	if !c.tx.Wait(len(b), c.die) {
+		return 0, ErrClosed
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.txBytes, int64(n))
+	return n, err
+}
+
+func (c *Conn) Close() (err error) {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// Stat return total bytes read and written
+func (c *Conn) Stat() (rx int64, tx int64) {
+	return atomic.LoadInt64(&c.rxBytes), atomic.LoadInt64(&c.txBytes)
+}
+
+// SetRxSpd change per-connection read speed (byte/sec), <= 0 no limit
+func (c *Conn) SetRxSpd(spd int) {
+	c.rx.SetRate(spd, 0)
+}
+
+// SetTxSpd change per-connection write speed (byte/sec), <= 0 no limit
+func (c *Conn) SetTxSpd(spd int) {
+	c.tx.SetRate(spd, 0)
+}
+
+// Unwrap return the original connection
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Listener wrap every accepted connection with per-connection buckets under rx and tx
+type Listener struct {
+	net.Listener
+	Rx    *Bucket // parent of per-connection RX bucket, can be nil
+	Tx    *Bucket // parent of per-connection TX bucket, can be nil
+	RxSpd int     // per-connection RX limit
+	TxSpd int     // per-connection TX limit
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, NewBucket(l.RxSpd, 0, l.Rx), NewBucket(l.TxSpd, 0, l.Tx)), nil
+}
@@ -1,14 +1,14 @@
+//go:build ignore
+
 // proxy any tcp connection from iptables REDIRECT to socks5 proxy
 // raw tcp client ---> iptables REDIRECT ---> socks5 proxy ---> raw tcp server
 package main
 
 import (
 	"flag"
-	"io"
 	"log"
 	"net"
 	"runtime"
-	"sync"
 	"time"
 
 	"errors"
@@ -17,6 +17,9 @@ import (
 
 	//	"fmt"
 	"strconv"
+
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/pipe"
 )
 
 var (
@@ -26,12 +29,12 @@ var (
 	socksAddr  = flag.String("s", "example.com:1080", "socks5 server addr")
 	targetAddr = flag.String("t", "192.168.1.1:80", "target addr")
 
-	// global recycle buffer
-	copyBuf = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 4096)
-		},
-	}
+	idleTimeout = flag.Int("idle", 0, "close tunnel after no data in both directions (Second), <= 0 disable")
+
+	dialTimeout = flag.Int("dt", 5, "dial timeout (Second)")
+	dialRetry   = flag.Int("dr", 0, "retry failed dial with backoff")
+	dnsTTL      = flag.Int("dns", 60, "cache DNS lookup (Second), 0 = no cache")
+	socksDialer *dialer.Dialer
 )
 
 // thank's https://github.com/shadowsocks/go-shadowsocks2
@@ -135,10 +138,7 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime)
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU() + 2)
-
-	copyBuf.New = func() interface{} {
-		return make([]byte, 4096)
-	}
+	socksDialer = dialer.New(time.Duration(*dialTimeout)*time.Second, *dialRetry, time.Duration(*dnsTTL)*time.Second)
 
 	listener, err := net.Listen("tcp", *localAddr)
 	if err != nil {
@@ -166,7 +166,7 @@ func handleConnection(p1 net.Conn) {
 	}
 	Vln(2, "OriginalDst:", addr, p1)
 
-	p2, err := net.DialTimeout("tcp", *socksAddr, 5*time.Second)
+	p2, err := socksDialer.Dial("tcp", *socksAddr)
 	if err != nil {
 		Vln(2, "connect to ", *socksAddr, err)
 		return
@@ -199,35 +199,8 @@ func handleConnection(p1 net.Conn) {
 		return
 	}
 
-	cp(p1, p2)
-}
-
-func cp(p1, p2 io.ReadWriteCloser) {
-	// defer p1.Close()
-	defer p2.Close()
-
-	// start tunnel
-	p1die := make(chan struct{})
-	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p1, p2, buf)
-		close(p1die)
-		copyBuf.Put(buf)
-	}()
-
-	p2die := make(chan struct{})
-	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p2, p1, buf)
-		close(p2die)
-		copyBuf.Put(buf)
-	}()
-
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
-	}
+	res := pipe.Join(p1, p2, time.Duration(*idleTimeout)*time.Second)
+	Vln(3, "close:", p1.RemoteAddr(), "up:", res.AtoB, "down:", res.BtoA)
 }
 
 func Vf(level int, format string, v ...interface{}) {
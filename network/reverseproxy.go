@@ -1,3 +1,5 @@
+//go:build ignore
+
 /*
 simple https to http proxy server
 for testing PWA on local side
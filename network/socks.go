@@ -1,121 +1,996 @@
-// This is a simple SOCKS5 proxy server.
+//go:build ignore
+
+// This is a simple SOCKS5 / SOCKS4 / HTTP proxy server on one port.
 // Copyright 2013-2015, physacco. Distributed under the MIT license.
 // modify by cs8425.
 
 package main
 
 import (
-	"io"
-	// "os"
-	// "fmt"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/cs8425/go-smalltools/network/acl"
+	"github.com/cs8425/go-smalltools/network/admin"
+	"github.com/cs8425/go-smalltools/network/dialer"
+	"github.com/cs8425/go-smalltools/network/pipe"
+	"github.com/cs8425/go-smalltools/network/proxyproto"
+	"github.com/cs8425/go-smalltools/network/ratelimit"
+	"github.com/cs8425/go-smalltools/network/socksproto"
+	"github.com/cs8425/go-smalltools/network/users"
 )
 
 var (
 	localAddr = flag.String("l", ":1080", "bind address")
 	outAddr   = flag.String("oaddr", "", "out going address")
 	outIf     = flag.String("oif", "", "out going interface")
+	ppTrusted = flag.String("ppt", "", "require PROXY protocol header from these IP/CIDR (spare by ';')")
+
+	dialTimeout = flag.Int("dt", 5, "dial timeout (Second)")
+	dialRetry   = flag.Int("dr", 0, "retry failed dial with backoff")
+	dnsTTL      = flag.Int("dns", 60, "cache DNS lookup (Second), 0 = no cache")
+
+	rxSpd = flag.Int("rx", 0, "RX speed per connection (byte/sec), 0 = no limit")
+	txSpd = flag.Int("tx", 0, "TX speed per connection (byte/sec), 0 = no limit")
+
+	globalRxSpd = flag.Int("grx", 0, "RX speed shared by all connections (byte/sec), 0 = no limit")
+	globalTxSpd = flag.Int("gtx", 0, "TX speed shared by all connections (byte/sec), 0 = no limit")
+	globalRx    *ratelimit.Bucket
+	globalTx    *ratelimit.Bucket
+
+	userRxSpd = flag.Int("urx", 0, "RX speed shared by all connections of one authenticated user (byte/sec), 0 = no limit")
+	userTxSpd = flag.Int("utx", 0, "TX speed shared by all connections of one authenticated user (byte/sec), 0 = no limit")
+
+	adminAddr  = flag.String("admin", "", "admin API listen address, empty to disable")
+	adminToken = flag.String("token", "", "admin API token")
+	adminSrv   *admin.Server
+
+	usersFile = flag.String("users", "", "username/password auth by users file (name:hash per line, hash by 'openssl passwd -6'), SIGHUP to reload, empty = no auth")
+	userDB    *users.DB
+
+	aclFile = flag.String("acl", "", "destination access rules file (action dest [ports [users]] per line), SIGHUP to reload, empty = allow all")
+	aclList *acl.List
+
+	socks4   = flag.Bool("s4", false, "accept SOCKS4/4a on the same port, refused with -users (no password in SOCKS4)")
+	socks4ID = flag.Bool("s4id", false, "take SOCKS4 USERID as the user name for log and -acl, NOT authenticated: any client can claim any name, so user rules of -acl are spoofable")
+
+	httpProxy = flag.Bool("http", false, "accept HTTP proxy (CONNECT and forward) on the same port")
+
+	handshakeTimeout = flag.Int("ht", 10, "handshake timeout, from connected to request read (Second)")
+
+	bindTimeout = flag.Int("bt", 60, "BIND wait the incoming connection (Second)")
+	bindAny     = flag.Bool("bany", false, "BIND accept any peer, default only the IP in DST.ADDR of request (0.0.0.0 = any)")
+
+	rule = &socksRule{}
+
+	idleTimeout = flag.Int("idle", 0, "close tunnel after no data in both directions (Second), <= 0 disable")
 
 	verbosity = flag.Int("v", 3, "verbosity")
+)
+
+// verHTTP mark request from HTTP proxy client
+const verHTTP = 0
+
+// request is one SOCKS4, SOCKS5 or HTTP proxy request after handshake
+type request struct {
+	*socksproto.Request
+	p1     net.Conn
+	user   string // authenticated user, empty if none
+	client string // for log and admin API
+	ver    byte
+	fwd    *http.Request // HTTP forward proxy, send to target instead of reply
+	br     *bufio.Reader // HTTP forward proxy, read the next request
+	src    *connReader   // under br
+}
+
+// connReader let the HTTP forward proxy read the next requests by the limited conn
+type connReader struct {
+	io.Reader
+}
 
-	// global recycle buffer
-	copyBuf = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 4096)
-		},
+// reply send the reply in the client protocol, rep is SOCKS5 reply code, BND.ADDR BND.PORT from addr
+func (req *request) reply(rep byte, addr net.Addr) error {
+	var b []byte
+	switch req.ver {
+	case socksproto.Ver4:
+		cd := byte(socksproto.Rep4Granted)
+		if rep != socksproto.RepSuccess {
+			cd = socksproto.Rep4Rejected
+		}
+		b = socksproto.AppendReply4(nil, cd, addr)
+	case verHTTP:
+		b = httpReply(httpStatus[rep], "")
+	default:
+		b = socksproto.AppendReply(nil, rep, addr)
 	}
-)
+	_, err := req.p1.Write(b)
+	return err
+}
 
-func replyAndClose(p1 net.Conn, rpy int) {
-	p1.Write([]byte{0x05, byte(rpy), 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	p1.Close()
+func (req *request) fail(rep byte) {
+	req.reply(rep, nil)
+	req.p1.Close()
 }
 
-// thanks: http://www.golangnote.com/topic/141.html
-func handleConnection(p1 net.Conn, dialer net.Dialer) {
-	var b [1024]byte
-	n, err := p1.Read(b[:])
+// negotiate pick the auth method from the client offered and do the auth, return the user name if any
+func negotiate(p1 net.Conn, r io.Reader) (string, error) {
+	methods, err := socksproto.ReadGreeting(r)
+	if err != nil {
+		return "", err
+	}
+
+	want := byte(socksproto.MethodNone)
+	if userDB != nil {
+		want = socksproto.MethodUserPass
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		p1.Write([]byte{socksproto.Ver5, socksproto.MethodNoAccepted})
+		return "", fmt.Errorf("no acceptable auth method in %v", methods)
+	}
+	p1.Write([]byte{socksproto.Ver5, want})
+	if want == socksproto.MethodNone {
+		return "", nil
+	}
+	return authUserPass(p1, r)
+}
+
+// authUserPass do RFC 1929 sub-negotiation
+func authUserPass(p1 net.Conn, r io.Reader) (string, error) {
+	user, pass, err := socksproto.ReadUserPass(r)
+	if err != nil {
+		return "", err
+	}
+	if !userDB.Check(user, pass) {
+		p1.Write([]byte{socksproto.UserPassVer, 0x01})
+		return "", errors.New("auth failed for user " + strconv.Quote(user))
+	}
+	p1.Write([]byte{socksproto.UserPassVer, 0x00})
+	return user, nil
+}
+
+func handshake5(p1 net.Conn, r io.Reader) (*request, error) {
+	user, err := negotiate(p1, r)
+	if err != nil {
+		return nil, err
+	}
+	sreq, err := socksproto.ReadRequest(r)
+	if err != nil {
+		if err == socksproto.ErrAddrType {
+			p1.Write(socksproto.AppendReply(nil, socksproto.RepAddrNotSupported, nil))
+		}
+		return nil, err
+	}
+	return &request{Request: sreq, p1: p1, user: user, client: clientName(p1, user), ver: socksproto.Ver5}, nil
+}
+
+// handshake4 read SOCKS4/4a request, no password in SOCKS4,
+// so refused with -users, and USERID by -s4id is only a claimed name
+func handshake4(p1 net.Conn, r io.Reader) (*request, error) {
+	sreq, userID, err := socksproto.ReadRequest4(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{Request: sreq, p1: p1, ver: socksproto.Ver4}
+	if userDB != nil {
+		req.reply(socksproto.RepNotAllowed, nil)
+		return nil, errors.New("SOCKS4 can not auth, refused with -users")
+	}
+	if *socks4ID {
+		req.user = userID
+	}
+	req.client = clientName(p1, req.user)
+	return req, nil
+}
+
+// HTTP status for SOCKS5 reply code
+var httpStatus = map[byte]int{
+	socksproto.RepSuccess:          http.StatusOK,
+	socksproto.RepFailure:          http.StatusBadGateway,
+	socksproto.RepNotAllowed:       http.StatusForbidden,
+	socksproto.RepNetUnreachable:   http.StatusBadGateway,
+	socksproto.RepHostUnreachable:  http.StatusBadGateway,
+	socksproto.RepRefused:          http.StatusBadGateway,
+	socksproto.RepTTLExpired:       http.StatusGatewayTimeout,
+	socksproto.RepCmdNotSupported:  http.StatusMethodNotAllowed,
+	socksproto.RepAddrNotSupported: http.StatusBadRequest,
+}
+
+func httpReply(code int, header string) []byte {
+	if code == http.StatusOK {
+		return []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n%vContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header))
+}
+
+// hop-by-hop headers not forwarded
+var hopHeaders = []string{"Proxy-Authorization", "Proxy-Connection", "Connection", "Keep-Alive", "Te", "Trailer", "Upgrade"}
+
+// handshakeHTTP read HTTP proxy request, CONNECT or one forwarded request with absolute URL,
+// Basic auth by Proxy-Authorization if -users
+func handshakeHTTP(p1 net.Conn, r io.Reader) (*request, error) {
+	src := &connReader{r}
+	br := bufio.NewReader(src)
+	hreq, err := http.ReadRequest(br)
+	if err != nil {
+		p1.Write(httpReply(http.StatusBadRequest, ""))
+		return nil, err
+	}
+
+	var user string
+	if userDB != nil {
+		auth := &http.Request{Header: http.Header{"Authorization": hreq.Header["Proxy-Authorization"]}}
+		name, pass, ok := auth.BasicAuth()
+		if !ok || !userDB.Check(name, pass) {
+			p1.Write(httpReply(http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n"))
+			if !ok {
+				return nil, errors.New("HTTP without auth")
+			}
+			return nil, errors.New("auth failed for user " + strconv.Quote(name))
+		}
+		user = name
+	}
+
+	req := &request{p1: p1, user: user, client: clientName(p1, user), ver: verHTTP}
+	if hreq.Method != http.MethodConnect {
+		req.Request, err = forwardTarget(hreq)
+		if err != nil {
+			p1.Write(httpReply(http.StatusBadRequest, ""))
+			return nil, err
+		}
+		req.fwd, req.br, req.src = hreq, br, src
+		return req, nil
+	}
+
+	req.Request, err = proxyTarget(hreq.Host, "443")
+	if err != nil {
+		p1.Write(httpReply(http.StatusBadRequest, ""))
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		// client not wait for 200, replay the data after header
+		early, _ := br.Peek(br.Buffered())
+		req.p1 = &prefixConn{Conn: p1, r: io.MultiReader(bytes.NewReader(early), p1)}
+	}
+	return req, nil
+}
+
+// forwardTarget check a forwarded request with absolute URL and strip hop-by-hop headers
+func forwardTarget(hreq *http.Request) (*socksproto.Request, error) {
+	if hreq.URL.Scheme != "http" || hreq.URL.Host == "" {
+		return nil, errors.New("not a proxy request: " + hreq.Method + " " + hreq.RequestURI)
+	}
+	for _, h := range hopHeaders {
+		hreq.Header.Del(h)
+	}
+	if _, ok := hreq.Header["User-Agent"]; !ok {
+		hreq.Header.Set("User-Agent", "") // not add Go default
+	}
+	return proxyTarget(hreq.URL.Host, "80")
+}
+
+func proxyTarget(host string, defPort string) (*socksproto.Request, error) {
+	h, port, err := net.SplitHostPort(host)
 	if err != nil {
-		Vln(3, "client read", p1, err)
+		h, port = host, defPort
+	}
+	nport, err := strconv.Atoi(port)
+	if err != nil || h == "" {
+		return nil, errors.New("bad host: " + host)
+	}
+	return &socksproto.Request{Cmd: socksproto.CmdConnect, Host: strings.Trim(h, "[]"), Port: nport}, nil
+}
+
+// prefixConn replay the buffered bytes before reading from conn
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *prefixConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// realLocalAddr return the address really accepted on through the wrappers,
+// not the one in PROXY protocol header
+func realLocalAddr(c net.Conn) net.Addr {
+	for {
+		u, ok := c.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return c.LocalAddr()
+		}
+		c = u.Unwrap()
+	}
+}
+
+// clientName is the client in log and admin API, with user name if authenticated
+func clientName(p1 net.Conn, user string) string {
+	if user == "" {
+		return p1.RemoteAddr().String()
+	}
+	return user + "@" + p1.RemoteAddr().String()
+}
+
+// dialReply map dial error to reply code
+func dialReply(err error) byte {
+	var dnsErr *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.Is(err, acl.ErrDenied):
+		return socksproto.RepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksproto.RepRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksproto.RepNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksproto.RepHostUnreachable
+	case errors.As(err, &ne) && ne.Timeout():
+		return socksproto.RepTTLExpired
+	}
+	return socksproto.RepFailure
+}
+
+// thanks: http://www.golangnote.com/topic/141.html
+func handleConnection(p1 net.Conn, d *dialer.Dialer) {
+	// whole handshake, include auth, in time
+	p1.SetDeadline(time.Now().Add(time.Duration(*handshakeTimeout) * time.Second))
+	var ver [1]byte
+	if _, err := io.ReadFull(p1, ver[:]); err != nil {
+		Vln(3, "socks handshake:", p1.RemoteAddr(), err)
 		p1.Close()
 		return
 	}
-	if b[0] != 0x05 { //only Socket5
+	// parser read the version again
+	r := io.MultiReader(bytes.NewReader(ver[:]), p1)
+
+	var req *request
+	var err error
+	switch {
+	case ver[0] == socksproto.Ver5:
+		req, err = handshake5(p1, r)
+	case ver[0] == socksproto.Ver4 && *socks4:
+		req, err = handshake4(p1, r)
+	case ver[0] >= 'A' && ver[0] <= 'Z' && *httpProxy: // HTTP method
+		req, err = handshakeHTTP(p1, r)
+	default:
+		err = fmt.Errorf("unknown version %v", ver[0])
+	}
+	if err != nil {
+		Vln(2, "socks handshake:", p1.RemoteAddr(), err)
 		p1.Close()
 		return
 	}
+	p1.SetDeadline(time.Time{})
 
-	//reply: NO AUTHENTICATION REQUIRED
-	p1.Write([]byte{0x05, 0x00})
+	switch {
+	case req.fwd != nil:
+		handleForward(req, d)
+	case req.Cmd == socksproto.CmdConnect:
+		handleConnect(req, d)
+	case req.Cmd == socksproto.CmdBind:
+		handleBind(req, d)
+	case req.Cmd == socksproto.CmdUDP && req.ver == socksproto.Ver5:
+		handleUDP(req, d)
+	default:
+		Vln(2, "socks command not supported:", req.client, req.Cmd)
+		req.fail(socksproto.RepCmdNotSupported)
+	}
+}
 
-	n, err = p1.Read(b[:])
-	if b[1] != 0x01 { // 0x01: CONNECT
-		replyAndClose(p1, 0x07) // X'07' Command not supported
-		return
+// checkACL return error if the destination denied by -acl, host is the domain name asked, empty if an IP
+func checkACL(user string, host string, ip net.IP, port int) error {
+	if aclList == nil {
+		return nil
+	}
+	ok, r := aclList.Check(acl.Dest{Host: host, IP: ip, Port: port, User: user})
+	if ok {
+		return nil
 	}
+	return fmt.Errorf("%w by %v", acl.ErrDenied, r)
+}
 
-	var host, port string
-	switch b[3] {
-	case 0x01: //IP V4
-		host = net.IPv4(b[4], b[5], b[6], b[7]).String()
-	case 0x03: //DOMAINNAME
-		host = string(b[5 : n-2]) //b[4] domain name length
-	case 0x04: //IP V6
-		host = net.IP{b[4], b[5], b[6], b[7], b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15], b[16], b[17], b[18], b[19]}.String()
-	default:
-		replyAndClose(p1, 0x08) // X'08' Address type not supported
-		return
+// aclDialer check by -acl every address really connected, so a domain resolved to internal network is caught too
+func aclDialer(req *request, d *dialer.Dialer) *dialer.Dialer {
+	if aclList == nil {
+		return d
 	}
-	port = strconv.Itoa(int(b[n-2])<<8 | int(b[n-1]))
-	backend := net.JoinHostPort(host, port)
-	p2, err := dialer.Dial("tcp", backend)
+	host := req.Host
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	dd := *d
+	dd.Control = func(network string, address string, c syscall.RawConn) error {
+		ip, _, _ := net.SplitHostPort(address)
+		if err := checkACL(req.user, host, net.ParseIP(ip), req.Port); err != nil {
+			return err
+		}
+		if d.Control != nil {
+			return d.Control(network, address, c)
+		}
+		return nil
+	}
+	return &dd
+}
+
+func handleConnect(req *request, d *dialer.Dialer) {
+	backend := req.Addr()
+	p2, err := aclDialer(req, d).Dial("tcp", backend)
 	if err != nil {
-		Vln(2, backend, err)
-		replyAndClose(p1, 0x05) // X'05'
+		Vln(2, req.client, backend, err)
+		req.fail(dialReply(err))
 		return
 	}
 
-	reply := []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	Vln(3, "socks to:", backend)
+	Vln(3, "socks to:", req.client, "->", backend)
 	Vln(6, "[dbg]conn", p2.LocalAddr(), "=>", p2.RemoteAddr())
-	p1.Write(reply) // reply OK
+	if err := req.reply(socksproto.RepSuccess, p2.LocalAddr()); err != nil {
+		req.p1.Close()
+		p2.Close()
+		return
+	}
 
-	go handleClient(p1, p2)
+	relay(req.p1, p2, req.user, req.client, backend)
 }
 
-func handleClient(p1, p2 io.ReadWriteCloser) {
-	defer p1.Close()
+// userBuckets return the parent buckets of a connection,
+// per-user buckets under the global ones if authenticated by -users
+func userBuckets(user string) (*ratelimit.Bucket, *ratelimit.Bucket) {
+	if user == "" || userDB == nil {
+		return globalRx, globalTx
+	}
+	return globalRx.Child(user, *userRxSpd, 0), globalTx.Child(user, *userTxSpd, 0)
+}
+
+// limitClient wrap p1 only when limit or traffic counter needed, so plain TCP can splice,
+// call done after the connection closed
+func limitClient(p1 net.Conn, user string, client string, backend string) (c1 net.Conn, done func()) {
+	rx, tx := rule.Limit()
+	prx, ptx := userBuckets(user)
+	if adminSrv == nil && rx <= 0 && tx <= 0 && !prx.Limited() && !ptx.Limited() {
+		return p1, func() {}
+	}
+	spdlim := ratelimit.NewConn(p1, ratelimit.NewBucket(rx, 0, prx), ratelimit.NewBucket(tx, 0, ptx))
+	if adminSrv == nil {
+		return spdlim, func() {}
+	}
+	tun := adminSrv.Add("socks", client, backend, spdlim)
+	return spdlim, func() { adminSrv.Remove(tun) }
+}
+
+// relay pipe the client and the other side until both closed
+func relay(p1 net.Conn, p2 net.Conn, user string, client string, backend string) {
+	c1, done := limitClient(p1, user, client, backend)
+	defer done()
+
+	res := pipe.Join(c1, p2, time.Duration(*idleTimeout)*time.Second)
+	Vln(3, "socks close:", client, "->", backend, "up:", res.AtoB, "down:", res.BtoA)
+}
+
+// handleForward send forwarded HTTP requests of a keep-alive client connection in turn,
+// each to the target in its URL by a new connection
+func handleForward(req *request, d *dialer.Dialer) {
+	c1, done := limitClient(req.p1, req.user, req.client, "http forward")
+	defer done()
+	defer c1.Close()
+	// only bytes already buffered skip the limit
+	req.p1, req.src.Reader = c1, c1
+
+	idle := time.Duration(*idleTimeout) * time.Second
+	for {
+		if !forwardOne(req, d) {
+			return
+		}
+
+		if idle > 0 {
+			c1.SetReadDeadline(time.Now().Add(idle))
+		}
+		hreq, err := http.ReadRequest(req.br)
+		if err != nil {
+			if err != io.EOF {
+				Vln(3, "http forward:", req.client, err)
+			}
+			return
+		}
+		c1.SetReadDeadline(time.Time{})
+		req.Request, err = forwardTarget(hreq)
+		if err != nil {
+			Vln(2, "http forward:", req.client, err)
+			req.fail(socksproto.RepAddrNotSupported)
+			return
+		}
+		req.fwd = hreq
+	}
+}
+
+// forwardOne send req.fwd and copy back the response, return true to read next request
+func forwardOne(req *request, d *dialer.Dialer) bool {
+	hreq := req.fwd
+	backend := req.Addr()
+	keep := !hreq.Close
+	if hreq.Header.Get("Expect") == "100-continue" {
+		// the body is sent after the target answered, no need to wait
+		hreq.Header.Del("Expect")
+		if _, err := io.WriteString(req.p1, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return false
+		}
+	}
+
+	p2, err := aclDialer(req, d).Dial("tcp", backend)
+	if err != nil {
+		Vln(2, req.client, backend, err)
+		req.fail(dialReply(err))
+		return false
+	}
 	defer p2.Close()
 
-	// start tunnel
-	p1die := make(chan struct{})
+	// one request per target connection, the response end at close if no length
+	hreq.Close = true
+	if err := hreq.Write(p2); err != nil {
+		Vln(2, "http forward:", req.client, backend, err)
+		req.fail(socksproto.RepFailure)
+		return false
+	}
+	br := bufio.NewReader(p2)
+	var resp *http.Response
+	for {
+		resp, err = http.ReadResponse(br, hreq)
+		if err != nil {
+			Vln(2, "http forward:", req.client, backend, err)
+			req.fail(socksproto.RepFailure)
+			return false
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		// skip 1xx info, Expect already answered
+		resp.Body.Close()
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	if !hreq.ProtoAtLeast(1, 1) {
+		// no chunked for HTTP/1.0 client, body end by close
+		resp.TransferEncoding = nil
+	}
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && hreq.Method != http.MethodHead {
+		keep = false
+	}
+	// we talk HTTP/1.1 to client whatever the target is
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.Close = !keep
+	Vln(3, "http forward:", req.client, hreq.Method, hreq.URL, resp.StatusCode)
+	if err := resp.Write(req.p1); err != nil {
+		Vln(3, "http forward:", req.client, backend, err)
+		return false
+	}
+	return keep
+}
+
+// max data kept from client before the BIND peer connected
+const bindEarlyMax = 64 * 1024
+
+// handleBind accept one connection from the peer, reply twice: listening address, then the peer address
+func handleBind(req *request, d *dialer.Dialer) {
+	p1 := req.p1
+	host, ip := req.Host, net.ParseIP(req.Host)
+	if ip != nil {
+		host = ""
+	}
+	if err := checkACL(req.user, host, ip, req.Port); err != nil {
+		Vln(2, "socks bind:", req.client, req.Addr(), err)
+		req.fail(socksproto.RepNotAllowed)
+		return
+	}
+
+	// listen where we go out, so the peer can reach us like CONNECT
+	var laddr net.TCPAddr
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	} else if addr, ok := realLocalAddr(p1).(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+	lc := net.ListenConfig{Control: d.Control}
+	ln, err := lc.Listen(context.Background(), "tcp", laddr.String())
+	if err != nil {
+		Vln(2, "socks bind:", req.client, err)
+		req.fail(socksproto.RepFailure)
+		return
+	}
+	defer ln.Close()
+
+	bnd := ln.Addr().(*net.TCPAddr)
+	if err := req.reply(socksproto.RepSuccess, bnd); err != nil {
+		p1.Close()
+		return
+	}
+	Vln(3, "socks bind:", req.client, "listen", bnd, "for", req.Host)
+
+	// client should wait for the second reply, EOF or error means it gone,
+	// data sent too early is kept for the peer
+	gone := make(chan struct{})
+	var early []byte
 	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p1, p2, buf)
-		close(p1die)
-		copyBuf.Put(buf)
+		defer close(gone)
+		buf := make([]byte, 4096)
+		for len(early) < bindEarlyMax {
+			n, err := p1.Read(buf)
+			early = append(early, buf[:n]...)
+			if err != nil {
+				return
+			}
+		}
+		Vln(2, "socks bind: too much data before peer connected", req.client)
 	}()
 
-	p2die := make(chan struct{})
+	p2, err := acceptPeer(ln.(*net.TCPListener), req.Host, d, gone)
+	p1.SetReadDeadline(time.Now())
+	<-gone
+	p1.SetReadDeadline(time.Time{})
+	if err != nil {
+		Vln(2, "socks bind:", req.client, bnd, err)
+		req.fail(socksproto.RepTTLExpired) // as timeout
+		return
+	}
+
+	peer := p2.RemoteAddr()
+	if err := req.reply(socksproto.RepSuccess, peer); err != nil {
+		p1.Close()
+		p2.Close()
+		return
+	}
+	if len(early) > 0 {
+		if _, err := p2.Write(early); err != nil {
+			p1.Close()
+			p2.Close()
+			return
+		}
+	}
+	relay(p1, p2, req.user, req.client, "bind "+peer.String())
+}
+
+// acceptPeer wait the incoming connection until -bt or client gone,
+// peer not in DST.ADDR is closed unless -bany
+func acceptPeer(ln *net.TCPListener, host string, d *dialer.Dialer, gone chan struct{}) (net.Conn, error) {
+	var allow []net.IP
+	if !*bindAny {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				allow = []net.IP{ip}
+			}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+			ips, err := d.LookupIP(ctx, host)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			allow = ips
+		}
+	}
+
+	ln.SetDeadline(time.Now().Add(time.Duration(*bindTimeout) * time.Second))
 	go func() {
-		buf := copyBuf.Get().([]byte)
-		io.CopyBuffer(p2, p1, buf)
-		close(p2die)
-		copyBuf.Put(buf)
+		<-gone
+		ln.SetDeadline(time.Now())
 	}()
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			select {
+			case <-gone:
+				return nil, errors.New("client gone")
+			default:
+			}
+			return nil, err
+		}
+		if allowed(allow, conn.RemoteAddr().(*net.TCPAddr).IP) {
+			return conn, nil
+		}
+		Vln(2, "socks bind: reject peer", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func allowed(list []net.IP, ip net.IP) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, a := range list {
+		if a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+const udpBufSize = 65535
+
+// udpAssoc relay datagrams of one UDP ASSOCIATE, live until the control connection close
+type udpAssoc struct {
+	ctrl  net.Conn
+	relay *net.UDPConn   // with client
+	out   net.PacketConn // with any destination
+	d     *dialer.Dialer
+	user  string // for -acl
+
+	// only datagram from here, zero port = lock to the first one
+	allowIP   net.IP
+	allowPort int
+
+	lock   sync.Mutex
+	client *net.UDPAddr
+
+	rx, tx     *ratelimit.Bucket
+	up, down   int64 // payload bytes, atomic
+	die        chan struct{}
+	dieOnce    sync.Once
+	dropped    int64 // datagram from other source, atomic
+	resolveErr int64 // atomic
+	denied     int64 // by -acl, atomic
+}
+
+func handleUDP(req *request, d *dialer.Dialer) {
+	p1, client := req.p1, req.client
+	defer p1.Close()
+
+	// DST of the request is where the client will send from, usually zero if unknown
+	allowIP := net.ParseIP(req.Host)
+	if allowIP == nil || allowIP.IsUnspecified() {
+		allowIP = nil
+		if addr, ok := p1.RemoteAddr().(*net.TCPAddr); ok {
+			allowIP = addr.IP
+		}
+	}
 
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
+	// relay on the address client connected, outgoing from -oaddr / -oif
+	var laddr net.UDPAddr
+	if addr, ok := realLocalAddr(p1).(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
 	}
+	relay, err := net.ListenUDP("udp", &laddr)
+	if err != nil {
+		Vln(2, "socks udp relay:", client, err)
+		req.fail(socksproto.RepFailure)
+		return
+	}
+	outAddr := ":0"
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		outAddr = net.JoinHostPort(addr.IP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: d.Control}
+	out, err := lc.ListenPacket(context.Background(), "udp", outAddr)
+	if err != nil {
+		relay.Close()
+		Vln(2, "socks udp out:", client, err)
+		req.fail(socksproto.RepFailure)
+		return
+	}
+
+	rx, tx := rule.Limit()
+	prx, ptx := userBuckets(req.user)
+	a := &udpAssoc{
+		ctrl:      p1,
+		relay:     relay,
+		out:       out,
+		d:         d,
+		user:      req.user,
+		allowIP:   allowIP,
+		allowPort: req.Port,
+		rx:        ratelimit.NewBucket(rx, 0, prx),
+		tx:        ratelimit.NewBucket(tx, 0, ptx),
+		die:       make(chan struct{}),
+	}
+	defer a.Close()
+
+	bnd := relay.LocalAddr().(*net.UDPAddr)
+	if err := req.reply(socksproto.RepSuccess, bnd); err != nil {
+		return
+	}
+	Vln(3, "socks udp:", client, "relay", bnd, "allow", allowIP, req.Port)
+
+	if adminSrv != nil {
+		tun := adminSrv.Add("socks", client, "udp "+bnd.String(), a)
+		defer adminSrv.Remove(tun)
+	}
+
+	go a.sendLoop()
+	go a.recvLoop()
+
+	// association end when the control connection close
+	io.Copy(ioutil.Discard, p1)
+	Vln(3, "socks udp close:", client, "up:", atomic.LoadInt64(&a.up), "down:", atomic.LoadInt64(&a.down),
+		"dropped:", atomic.LoadInt64(&a.dropped), "resolve failed:", atomic.LoadInt64(&a.resolveErr),
+		"denied:", atomic.LoadInt64(&a.denied))
+}
+
+// allow check the source of datagram, lock the client address at the first one
+func (a *udpAssoc) allow(addr *net.UDPAddr) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.client != nil {
+		return addr.IP.Equal(a.client.IP) && addr.Port == a.client.Port
+	}
+	if a.allowIP != nil && !addr.IP.Equal(a.allowIP) {
+		return false
+	}
+	if a.allowPort != 0 && addr.Port != a.allowPort {
+		return false
+	}
+	a.client = addr
+	return true
+}
+
+func (a *udpAssoc) getClient() *net.UDPAddr {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.client
+}
+
+func (a *udpAssoc) resolve(host string, port int) (*net.UDPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.d.Timeout)
+		defer cancel()
+		ips, err := a.d.LookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// client -> destination: RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+func (a *udpAssoc) sendLoop() {
+	defer a.Close()
+	buf := make([]byte, udpBufSize)
+	for {
+		n, caddr, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.allow(caddr) {
+			atomic.AddInt64(&a.dropped, 1)
+			continue
+		}
+		// fragment not supported, drop as RFC 1928 allowed
+		host, port, data, err := socksproto.ParseUDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		dst, err := a.resolve(host, port)
+		if err != nil {
+			atomic.AddInt64(&a.resolveErr, 1)
+			Vln(4, "socks udp resolve:", host, err)
+			continue
+		}
+		if net.ParseIP(host) != nil {
+			host = ""
+		}
+		if err := checkACL(a.user, host, dst.IP, port); err != nil {
+			atomic.AddInt64(&a.denied, 1)
+			Vln(4, "socks udp:", dst, err)
+			continue
+		}
+		if !a.rx.Wait(len(data), a.die) {
+			return
+		}
+		if _, err := a.out.WriteTo(data, dst); err != nil {
+			Vln(4, "socks udp write:", dst, err)
+			continue
+		}
+		atomic.AddInt64(&a.up, int64(len(data)))
+	}
+}
+
+// destination -> client, with the source address in header
+func (a *udpAssoc) recvLoop() {
+	defer a.Close()
+	buf := make([]byte, udpBufSize)
+	for {
+		n, raddr, err := a.out.ReadFrom(buf[socksproto.UDPHeaderMax:])
+		if err != nil {
+			return
+		}
+		client := a.getClient()
+		src, ok := raddr.(*net.UDPAddr)
+		if client == nil || !ok {
+			continue
+		}
+
+		var hdr [socksproto.UDPHeaderMax]byte
+		h := socksproto.AppendUDPHeader(hdr[:0], src.IP, src.Port)
+		start := socksproto.UDPHeaderMax - len(h)
+		copy(buf[start:], h)
+		if !a.tx.Wait(n, a.die) {
+			return
+		}
+		if _, err := a.relay.WriteToUDP(buf[start:socksproto.UDPHeaderMax+n], client); err != nil {
+			Vln(4, "socks udp write client:", client, err)
+			continue
+		}
+		atomic.AddInt64(&a.down, int64(n))
+	}
+}
+
+// Stat, SetRxSpd, SetTxSpd, Close for admin API
+func (a *udpAssoc) Stat() (rx int64, tx int64) {
+	return atomic.LoadInt64(&a.up), atomic.LoadInt64(&a.down)
+}
+
+func (a *udpAssoc) SetRxSpd(spd int) {
+	a.rx.SetRate(spd, 0)
+}
+
+func (a *udpAssoc) SetTxSpd(spd int) {
+	a.tx.SetRate(spd, 0)
+}
+
+func (a *udpAssoc) Close() error {
+	a.dieOnce.Do(func() {
+		close(a.die)
+		a.relay.Close()
+		a.out.Close()
+		a.ctrl.Close()
+	})
+	return nil
+}
+
+// socksRule is the only rule, for admin API
+type socksRule struct {
+	off   int32
+	lock  sync.Mutex
+	rxLim int
+	txLim int
+}
+
+func (r *socksRule) Enabled() bool {
+	return atomic.LoadInt32(&r.off) == 0
+}
+
+func (r *socksRule) SetEnabled(on bool) {
+	var off int32
+	if !on {
+		off = 1
+	}
+	atomic.StoreInt32(&r.off, off)
+	Vln(2, "[rule]enabled:", on)
+}
+
+func (r *socksRule) Limit() (rx int, tx int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rxLim, r.txLim
+}
+
+func (r *socksRule) SetLimit(rx int, tx int) {
+	r.lock.Lock()
+	r.rxLim, r.txLim = rx, tx
+	r.lock.Unlock()
+	Vln(2, "[rule]limit RX:", rx, "TX:", tx)
 }
 
 func main() {
@@ -129,9 +1004,16 @@ func main() {
 	}
 	log.Printf("Listening on %s...\n", *localAddr)
 
-	dialer := net.Dialer{
-		Timeout: 5 * time.Second,
+	trusted, err := proxyproto.ParseTrusted(*ppTrusted)
+	if err != nil {
+		log.Fatal("PROXY protocol trusted list error: ", err)
 	}
+	if len(trusted) > 0 {
+		listener = proxyproto.NewListener(listener, trusted)
+		log.Printf("accept PROXY protocol from: %s\n", *ppTrusted)
+	}
+
+	d := dialer.New(time.Duration(*dialTimeout)*time.Second, *dialRetry, time.Duration(*dnsTTL)*time.Second)
 	if *outIf != "" {
 		ief, err := net.InterfaceByName(*outIf)
 		if err != nil {
@@ -144,10 +1026,10 @@ func main() {
 		tcpAddr := &net.TCPAddr{
 			IP: addrs[0].(*net.IPNet).IP,
 		}
-		dialer.LocalAddr = tcpAddr
+		d.LocalAddr = tcpAddr
 
 		// Linux can bind to particular interface
-		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+		d.Control = func(network string, address string, c syscall.RawConn) error {
 			var operr error
 			fn := func(fd uintptr) {
 				operr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, *outIf)
@@ -174,7 +1056,66 @@ func main() {
 		if err != nil {
 			log.Fatal("set out going address error:", err)
 		}
-		dialer.LocalAddr = addr
+		d.LocalAddr = addr
+	}
+
+	if *usersFile != "" {
+		userDB, err = users.Load(*usersFile)
+		if err != nil {
+			log.Fatal("load users error: ", err)
+		}
+		log.Printf("username/password auth, %v users from %s\n", userDB.Len(), *usersFile)
+	}
+	if *aclFile != "" {
+		aclList, err = acl.Load(*aclFile)
+		if err != nil {
+			log.Fatal("load acl error: ", err)
+		}
+		aclList.Log = func(r *acl.Rule, d acl.Dest) {
+			Vln(2, "socks acl:", d, "match", r)
+		}
+		log.Printf("destination access rules, %v rules from %s\n", aclList.Len(), *aclFile)
+	}
+	if *socks4 && userDB != nil {
+		log.Println("SOCKS4 refused, no password in SOCKS4 to check with -users")
+	}
+	if *socks4 && *socks4ID && userDB == nil && aclList != nil {
+		log.Println("WARNING: -s4id user name is not authenticated, user rules of -acl can be bypassed by SOCKS4 client")
+	}
+	if userDB != nil || aclList != nil {
+		// reload users and rules on SIGHUP, keep the old one on error
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGHUP)
+			for range sig {
+				if userDB != nil {
+					if err := userDB.Reload(); err != nil {
+						log.Println("SIGHUP: reload users error:", err)
+					} else {
+						log.Printf("SIGHUP: %v users reloaded\n", userDB.Len())
+					}
+				}
+				if aclList != nil {
+					if err := aclList.Reload(); err != nil {
+						log.Println("SIGHUP: reload acl error:", err)
+					} else {
+						log.Printf("SIGHUP: %v acl rules reloaded\n", aclList.Len())
+					}
+				}
+			}
+		}()
+	}
+
+	rule.SetLimit(*rxSpd, *txSpd)
+	globalRx = ratelimit.NewBucket(*globalRxSpd, 0, nil)
+	globalTx = ratelimit.NewBucket(*globalTxSpd, 0, nil)
+	if *adminAddr != "" {
+		if *adminToken == "" {
+			log.Fatal("admin API need a token")
+		}
+		adminSrv = admin.NewServer(*adminToken)
+		adminSrv.AddRule("socks", rule)
+		go adminSrv.ListenAndServe(*adminAddr)
 	}
 
 	for {
@@ -183,7 +1124,11 @@ func main() {
 			log.Println("Accept error:", err)
 			continue
 		}
-		go handleConnection(conn, dialer)
+		if !rule.Enabled() {
+			conn.Close()
+			continue
+		}
+		go handleConnection(conn, d)
 	}
 }
 
@@ -0,0 +1,115 @@
+package socksproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// SOCKS4 and the 4a extension: https://www.openssh.com/txt/socks4.protocol, https://www.openssh.com/txt/socks4a.protocol
+
+const (
+	Ver4 = 0x04
+
+	Rep4Granted   = 90
+	Rep4Rejected  = 91 // rejected or failed
+	Rep4NoIdentd  = 92
+	Rep4BadUserID = 93
+
+	maxString4 = 255 // USERID and 4a domain, NUL terminated without length
+)
+
+var ErrTooLong = errors.New("socksproto: string too long")
+
+// ReadRequest4 read VN CD DSTPORT DSTIP USERID NUL, then DOMAIN NUL if SOCKS4a (DSTIP 0.0.0.x, x != 0),
+// return the request and USERID
+func ReadRequest4(r io.Reader) (*Request, string, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, "", err
+	}
+	if hdr[0] != Ver4 {
+		return nil, "", ErrVersion
+	}
+	req := &Request{
+		Cmd:  hdr[1],
+		Host: net.IP(hdr[4:8]).String(),
+		Port: int(hdr[2])<<8 | int(hdr[3]),
+	}
+
+	user, err := readString4(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+		if req.Host, err = readString4(r); err != nil {
+			return nil, "", err
+		}
+		if req.Host == "" {
+			return nil, "", ErrAddr
+		}
+	}
+	return req, user, nil
+}
+
+// Append4 append the request in SOCKS4 wire format, SOCKS4a for domain name
+func (req *Request) Append4(b []byte, user string) ([]byte, error) {
+	if strings.IndexByte(user, 0) >= 0 || len(user) > maxString4 {
+		return b, ErrAddr
+	}
+	b = append(b, Ver4, req.Cmd, byte(req.Port>>8), byte(req.Port))
+	if ip := net.ParseIP(req.Host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return b, ErrAddrType
+		}
+		b = append(b, ip4...)
+		b = append(b, user...)
+		return append(b, 0), nil
+	}
+
+	if req.Host == "" || strings.IndexByte(req.Host, 0) >= 0 || len(req.Host) > maxString4 {
+		return b, ErrAddr
+	}
+	b = append(b, 0, 0, 0, 1)
+	b = append(b, user...)
+	b = append(b, 0)
+	b = append(b, req.Host...)
+	return append(b, 0), nil
+}
+
+// AppendReply4 append VN(0) CD DSTPORT DSTIP, zero address if addr is not IPv4
+func AppendReply4(b []byte, cd byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP.To4(), a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP.To4(), a.Port
+	}
+	if ip == nil {
+		ip, port = net.IPv4zero.To4(), 0
+	}
+	b = append(b, 0x00, cd, byte(port>>8), byte(port))
+	return append(b, ip...)
+}
+
+// readString4 read a NUL terminated string byte by byte, so nothing read past it
+func readString4(r io.Reader) (string, error) {
+	var b [1]byte
+	var sb strings.Builder
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", noEOF(err)
+		}
+		if b[0] == 0 {
+			return sb.String(), nil
+		}
+		if sb.Len() >= maxString4 {
+			return "", ErrTooLong
+		}
+		sb.WriteByte(b[0])
+	}
+}
@@ -0,0 +1,139 @@
+package socksproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var request4Tests = []struct {
+	name string
+	in   []byte
+	want Request
+	user string
+}{
+	{"socks4", []byte{4, 1, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0}, Request{CmdConnect, "10.0.0.1", 80}, "bob"},
+	{"no userid", []byte{4, 2, 0x15, 0xb3, 192, 168, 1, 9, 0}, Request{CmdBind, "192.168.1.9", 5555}, ""},
+	{"socks4a", append([]byte{4, 1, 1, 0xbb, 0, 0, 0, 7, 0}, "example.com\x00"...), Request{CmdConnect, "example.com", 443}, ""},
+	{"0.0.0.0 is not 4a", []byte{4, 1, 0, 80, 0, 0, 0, 0, 'u', 0}, Request{CmdConnect, "0.0.0.0", 80}, "u"},
+}
+
+func TestReadRequest4(t *testing.T) {
+	tail := []byte("GET / HTTP/1.0\r\n")
+	for _, tt := range request4Tests {
+		in := append(append([]byte{}, tt.in...), tail...)
+		readers := map[string]io.Reader{
+			"whole":    bytes.NewReader(in),
+			"one byte": iotest.OneByteReader(bytes.NewReader(in)),
+		}
+		for rname, r := range readers {
+			req, user, err := ReadRequest4(r)
+			if err != nil {
+				t.Fatalf("%v/%v: %v", tt.name, rname, err)
+			}
+			if *req != tt.want || user != tt.user {
+				t.Errorf("%v/%v: got %+v %q, want %+v %q", tt.name, rname, *req, user, tt.want, tt.user)
+			}
+			rest, _ := io.ReadAll(r)
+			if !bytes.Equal(rest, tail) {
+				t.Errorf("%v/%v: read past request, rest %q", tt.name, rname, rest)
+			}
+		}
+
+		for i := 1; i < len(tt.in); i++ {
+			if _, _, err := ReadRequest4(bytes.NewReader(tt.in[:i])); err != io.ErrUnexpectedEOF {
+				t.Errorf("%v cut at %v: err = %v", tt.name, i, err)
+			}
+		}
+	}
+}
+
+func TestReadRequest4Bad(t *testing.T) {
+	long := append([]byte{4, 1, 0, 80, 1, 2, 3, 4}, strings.Repeat("u", 300)...)
+	if _, _, err := ReadRequest4(bytes.NewReader(long)); err != ErrTooLong {
+		t.Errorf("long userid err = %v", err)
+	}
+	if _, _, err := ReadRequest4(bytes.NewReader([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 0})); err != ErrAddr {
+		t.Errorf("empty 4a domain err = %v", err)
+	}
+	if _, _, err := ReadRequest4(bytes.NewReader([]byte{5, 1, 0, 80, 1, 2, 3, 4, 0})); err != ErrVersion {
+		t.Errorf("version 5 err = %v", err)
+	}
+}
+
+func TestAppend4(t *testing.T) {
+	for _, tt := range request4Tests {
+		if tt.want.Host == "0.0.0.0" {
+			continue
+		}
+		b, err := tt.want.Append4(nil, tt.user)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		req, user, err := ReadRequest4(bytes.NewReader(b))
+		if err != nil || *req != tt.want || user != tt.user {
+			t.Errorf("%v: round trip %+v %q %v", tt.name, req, user, err)
+		}
+	}
+	req := &Request{CmdConnect, "::1", 80}
+	if _, err := req.Append4(nil, ""); err != ErrAddrType {
+		t.Errorf("IPv6 err = %v", err)
+	}
+
+	got := AppendReply4(nil, Rep4Granted, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1080})
+	want := []byte{0, 90, 0x04, 0x38, 10, 1, 2, 3}
+	if !bytes.Equal(got, want) {
+		t.Errorf("reply %v, want %v", got, want)
+	}
+	got = AppendReply4(nil, Rep4Rejected, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1080})
+	want = []byte{0, 91, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Errorf("IPv6 reply %v, want %v", got, want)
+	}
+}
+
+// FuzzReadRequest4 check any split of input parse the same as one read,
+// never read past the request, and a parsed request encode back
+func FuzzReadRequest4(f *testing.F) {
+	for _, tt := range request4Tests {
+		f.Add(tt.in, []byte{0})
+		f.Add(tt.in, []byte{4, 1})
+	}
+	f.Add([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, []byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte, sizes []byte) {
+		br := bytes.NewReader(data)
+		req, user, err := ReadRequest4(br)
+		cr := &chunkReader{data: data, sizes: sizes}
+		req2, user2, err2 := ReadRequest4(cr)
+
+		if err != err2 {
+			t.Fatalf("split input err = %v, one read err = %v", err2, err)
+		}
+		if br.Len() != len(cr.data) {
+			t.Fatalf("split input left %v bytes, one read left %v", len(cr.data), br.Len())
+		}
+		if err != nil {
+			return
+		}
+		if *req != *req2 || user != user2 {
+			t.Fatalf("split input %+v %q, one read %+v %q", *req2, user2, *req, user)
+		}
+
+		// 4a domain looks like an IP is sent as IP, and 0.0.0.x can not be a SOCKS4 address
+		if ip := net.ParseIP(req.Host); ip != nil && (ip.To4() == nil || ip.To4()[0] == 0) {
+			return
+		}
+		buf, err := req.Append4(nil, user)
+		if err != nil {
+			t.Fatalf("encode %+v %q: %v", *req, user, err)
+		}
+		req3, user3, err := ReadRequest4(bytes.NewReader(buf))
+		if err != nil || req3.Cmd != req.Cmd || req3.Port != req.Port || !sameHost(req3.Host, req.Host) || user3 != user {
+			t.Fatalf("round trip %+v %q -> %+v %q %v", *req, user, req3, user3, err)
+		}
+	})
+}
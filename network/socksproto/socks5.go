@@ -0,0 +1,258 @@
+// Package socksproto is the SOCKS wire format: SOCKS5 (RFC 1928, RFC 1929 username/password) and SOCKS4/4a.
+//
+// Every field is read by its exact length, so input split into any pieces
+// is the same as in one read, and nothing is read past the message.
+package socksproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Ver5        = 0x05
+	UserPassVer = 0x01 // RFC 1929
+
+	MethodNone       = 0x00
+	MethodUserPass   = 0x02
+	MethodNoAccepted = 0xff
+
+	CmdConnect = 0x01
+	CmdBind    = 0x02
+	CmdUDP     = 0x03 // UDP ASSOCIATE
+
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+
+	RepSuccess          = 0x00
+	RepFailure          = 0x01 // general SOCKS server failure
+	RepNotAllowed       = 0x02 // connection not allowed by ruleset
+	RepNetUnreachable   = 0x03
+	RepHostUnreachable  = 0x04
+	RepRefused          = 0x05
+	RepTTLExpired       = 0x06
+	RepCmdNotSupported  = 0x07
+	RepAddrNotSupported = 0x08
+
+	// UDPHeaderMax is the UDP header size with an IP address: RSV FRAG ATYP IPv6 PORT
+	UDPHeaderMax = 3 + 1 + net.IPv6len + 2
+)
+
+var (
+	ErrVersion  = errors.New("socksproto: bad version")
+	ErrAddrType = errors.New("socksproto: address type not supported")
+	ErrAddr     = errors.New("socksproto: bad address")
+	ErrFragment = errors.New("socksproto: UDP fragment not supported")
+)
+
+// ReadGreeting read VER NMETHODS METHODS, return the offered methods
+func ReadGreeting(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != Ver5 {
+		return nil, ErrVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, noEOF(err)
+	}
+	return methods, nil
+}
+
+// ReadUserPass read VER ULEN UNAME PLEN PASSWD
+func ReadUserPass(r io.Reader) (user string, pass string, err error) {
+	var b [256]byte
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	if b[0] != UserPassVer {
+		return "", "", ErrVersion
+	}
+	if user, err = readString(r, int(b[1])); err != nil {
+		return "", "", err
+	}
+	if _, err = io.ReadFull(r, b[:1]); err != nil {
+		return "", "", noEOF(err)
+	}
+	if pass, err = readString(r, int(b[0])); err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+// Request is the client request, Host is an IP or a domain name
+type Request struct {
+	Cmd  byte
+	Host string
+	Port int
+}
+
+// Addr return host:port to dial
+func (req *Request) Addr() string {
+	return net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+}
+
+// Append append the request in wire format
+func (req *Request) Append(b []byte) ([]byte, error) {
+	return AppendAddr(append(b, Ver5, req.Cmd, 0x00), req.Host, req.Port)
+}
+
+// ReadRequest read VER CMD RSV ATYP DST.ADDR DST.PORT, the command is not checked
+func ReadRequest(r io.Reader) (*Request, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != Ver5 {
+		return nil, ErrVersion
+	}
+	host, port, err := ReadAddr(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	return &Request{Cmd: hdr[1], Host: host, Port: port}, nil
+}
+
+// ReadAddr read ATYP ADDR PORT
+func ReadAddr(r io.Reader) (host string, port int, err error) {
+	var b [1 + net.IPv6len]byte
+	if _, err = io.ReadFull(r, b[:1]); err != nil {
+		return
+	}
+	switch b[0] {
+	case AtypIPv4:
+		if _, err = io.ReadFull(r, b[:net.IPv4len]); err != nil {
+			return "", 0, noEOF(err)
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+	case AtypIPv6:
+		if _, err = io.ReadFull(r, b[:net.IPv6len]); err != nil {
+			return "", 0, noEOF(err)
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+	case AtypDomain:
+		if _, err = io.ReadFull(r, b[:1]); err != nil {
+			return "", 0, noEOF(err)
+		}
+		if b[0] == 0 {
+			return "", 0, ErrAddr
+		}
+		if host, err = readString(r, int(b[0])); err != nil {
+			return "", 0, err
+		}
+	default:
+		return "", 0, ErrAddrType
+	}
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return "", 0, noEOF(err)
+	}
+	return host, int(b[0])<<8 | int(b[1]), nil
+}
+
+// ParseAddr parse ATYP ADDR PORT from b, return the bytes used, 0 if too short or bad
+func ParseAddr(b []byte) (host string, port int, n int) {
+	if len(b) < 1 {
+		return
+	}
+	switch b[0] {
+	case AtypIPv4:
+		n = 1 + net.IPv4len
+		if len(b) >= n {
+			host = net.IP(b[1:n]).String()
+		}
+	case AtypIPv6:
+		n = 1 + net.IPv6len
+		if len(b) >= n {
+			host = net.IP(b[1:n]).String()
+		}
+	case AtypDomain:
+		if len(b) >= 2 && b[1] > 0 {
+			n = 2 + int(b[1])
+			if len(b) >= n {
+				host = string(b[2:n])
+			}
+		}
+	}
+	if n == 0 || len(b) < n+2 {
+		return "", 0, 0
+	}
+	return host, int(b[n])<<8 | int(b[n+1]), n + 2
+}
+
+// AppendAddr append ATYP ADDR PORT, host is an IP or a domain name
+func AppendAddr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return AppendIP(b, ip, port), nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return b, ErrAddr
+	}
+	b = append(b, AtypDomain, byte(len(host)))
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// AppendIP append ATYP ADDR PORT of an IP address
+func AppendIP(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// AppendReply append VER REP RSV ATYP BND.ADDR BND.PORT, zero IPv4 address if addr is not TCP or UDP
+func AppendReply(b []byte, rep byte, addr net.Addr) []byte {
+	b = append(b, Ver5, rep, 0x00)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return AppendIP(b, a.IP, a.Port)
+	case *net.UDPAddr:
+		return AppendIP(b, a.IP, a.Port)
+	}
+	return AppendIP(b, net.IPv4zero, 0)
+}
+
+// ParseUDP parse RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+func ParseUDP(b []byte) (host string, port int, data []byte, err error) {
+	if len(b) < 3 {
+		return "", 0, nil, ErrAddr
+	}
+	if b[2] != 0 {
+		return "", 0, nil, ErrFragment
+	}
+	host, port, n := ParseAddr(b[3:])
+	if n == 0 {
+		return "", 0, nil, ErrAddr
+	}
+	return host, port, b[3+n:], nil
+}
+
+// AppendUDPHeader append RSV FRAG ATYP ADDR PORT of an IP address
+func AppendUDPHeader(b []byte, ip net.IP, port int) []byte {
+	return AppendIP(append(b, 0x00, 0x00, 0x00), ip, port)
+}
+
+func readString(r io.Reader, n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", noEOF(err)
+	}
+	return string(buf), nil
+}
+
+// noEOF turn EOF in the middle of a message to unexpected EOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package socksproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader return the data in pieces, piece sizes taken from sizes in turn
+type chunkReader struct {
+	data  []byte
+	sizes []byte
+	i     int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := 1
+	if len(r.sizes) > 0 {
+		n = int(r.sizes[r.i%len(r.sizes)])%8 + 1
+		r.i++
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func sameHost(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA != nil || ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+var requestTests = []struct {
+	name string
+	in   []byte
+	want Request
+}{
+	{"ipv4", []byte{5, 1, 0, 1, 10, 0, 0, 1, 0x1f, 0x90}, Request{CmdConnect, "10.0.0.1", 8080}},
+	{"ipv6", []byte{5, 3, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}, Request{CmdUDP, "2001:db8::1", 53}},
+	{"domain", append([]byte{5, 2, 0, 3, 11}, "example.com\x01\xbb"...), Request{CmdBind, "example.com", 443}},
+	{"unknown cmd", []byte{5, 9, 0, 1, 0, 0, 0, 0, 0, 0}, Request{9, "0.0.0.0", 0}},
+}
+
+func TestReadRequest(t *testing.T) {
+	tail := []byte("payload after request")
+	for _, tt := range requestTests {
+		in := append(append([]byte{}, tt.in...), tail...)
+		readers := map[string]io.Reader{
+			"whole":    bytes.NewReader(in),
+			"one byte": iotest.OneByteReader(bytes.NewReader(in)),
+			"chunk":    &chunkReader{data: in, sizes: []byte{2, 0, 5}},
+		}
+		for rname, r := range readers {
+			req, err := ReadRequest(r)
+			if err != nil {
+				t.Fatalf("%v/%v: %v", tt.name, rname, err)
+			}
+			if *req != tt.want {
+				t.Errorf("%v/%v: got %+v, want %+v", tt.name, rname, *req, tt.want)
+			}
+			rest, _ := io.ReadAll(r)
+			if !bytes.Equal(rest, tail) {
+				t.Errorf("%v/%v: read past request, rest %q", tt.name, rname, rest)
+			}
+		}
+	}
+}
+
+func TestReadRequestTruncated(t *testing.T) {
+	for _, tt := range requestTests {
+		for i := 0; i < len(tt.in); i++ {
+			_, err := ReadRequest(bytes.NewReader(tt.in[:i]))
+			want := io.ErrUnexpectedEOF
+			if i == 0 {
+				want = io.EOF
+			}
+			if err != want {
+				t.Errorf("%v cut at %v: err = %v, want %v", tt.name, i, err, want)
+			}
+		}
+	}
+}
+
+func TestReadRequestBad(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"version 4", []byte{4, 1, 0, 1, 1, 2, 3, 4, 0, 80}, ErrVersion},
+		{"address type", []byte{5, 1, 0, 2, 1, 2, 3, 4, 0, 80}, ErrAddrType},
+		{"empty domain", []byte{5, 1, 0, 3, 0, 0, 80}, ErrAddr},
+	}
+	for _, tt := range tests {
+		if _, err := ReadRequest(bytes.NewReader(tt.in)); err != tt.want {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReadGreetingUserPass(t *testing.T) {
+	in := []byte{5, 2, 0, 2, 1, 5, 'a', 'l', 'i', 'c', 'e', 0, 'x'}
+	r := iotest.OneByteReader(bytes.NewReader(in))
+	methods, err := ReadGreeting(r)
+	if err != nil || !bytes.Equal(methods, []byte{0, 2}) {
+		t.Fatalf("methods = %v, err = %v", methods, err)
+	}
+	user, pass, err := ReadUserPass(r)
+	if err != nil || user != "alice" || pass != "" {
+		t.Fatalf("user = %q, pass = %q, err = %v", user, pass, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "x" {
+		t.Fatalf("read past auth, rest %q", rest)
+	}
+
+	if _, err := ReadGreeting(bytes.NewReader([]byte{5, 3, 0})); err != io.ErrUnexpectedEOF {
+		t.Fatalf("short methods err = %v", err)
+	}
+	if _, _, err := ReadUserPass(bytes.NewReader([]byte{1, 3, 'b', 'o', 'b', 4, 'p'})); err != io.ErrUnexpectedEOF {
+		t.Fatalf("short password err = %v", err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	hdr := AppendUDPHeader(nil, net.ParseIP("192.168.1.2"), 5353)
+	if len(hdr) != 10 {
+		t.Fatalf("IPv4 header size = %v", len(hdr))
+	}
+	host, port, data, err := ParseUDP(append(hdr, "dns"...))
+	if err != nil || host != "192.168.1.2" || port != 5353 || string(data) != "dns" {
+		t.Fatalf("got %v %v %q %v", host, port, data, err)
+	}
+
+	if n := len(AppendUDPHeader(nil, net.ParseIP("::1"), 1)); n != UDPHeaderMax {
+		t.Fatalf("IPv6 header size = %v, want %v", n, UDPHeaderMax)
+	}
+	if _, _, _, err := ParseUDP([]byte{0, 0, 1, 1, 1, 2, 3, 4, 0, 53}); err != ErrFragment {
+		t.Fatalf("fragment err = %v", err)
+	}
+	if _, _, _, err := ParseUDP([]byte{0, 0, 0, 3, 5, 'a'}); err != ErrAddr {
+		t.Fatalf("short domain err = %v", err)
+	}
+}
+
+func TestAppendReply(t *testing.T) {
+	got := AppendReply(nil, RepSuccess, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1080})
+	want := []byte{5, 0, 0, 1, 10, 1, 2, 3, 0x04, 0x38}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	got = AppendReply(nil, RepRefused, nil)
+	want = []byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// FuzzReadRequest check any split of input parse the same as one read,
+// never read past the request, and a parsed request encode back
+func FuzzReadRequest(f *testing.F) {
+	for _, tt := range requestTests {
+		f.Add(tt.in, []byte{0})
+		f.Add(tt.in, []byte{3, 1, 7})
+	}
+	f.Add([]byte{5, 1, 0, 3, 0, 0, 80}, []byte{})
+	f.Add([]byte{5, 1, 0, 3, 255}, []byte{1})
+	f.Add([]byte{5, 1, 0, 3, 9, '1', '2', '7', '.', '0', '.', '0', '.', '1', 0, 80}, []byte{2})
+
+	f.Fuzz(func(t *testing.T, data []byte, sizes []byte) {
+		br := bytes.NewReader(data)
+		req, err := ReadRequest(br)
+		cr := &chunkReader{data: data, sizes: sizes}
+		req2, err2 := ReadRequest(cr)
+
+		if err != err2 {
+			t.Fatalf("split input err = %v, one read err = %v", err2, err)
+		}
+		if br.Len() != len(cr.data) {
+			t.Fatalf("split input left %v bytes, one read left %v", len(cr.data), br.Len())
+		}
+		if err != nil {
+			return
+		}
+		if *req != *req2 {
+			t.Fatalf("split input %+v, one read %+v", *req2, *req)
+		}
+
+		buf, err := req.Append(nil)
+		if err != nil {
+			t.Fatalf("encode %+v: %v", *req, err)
+		}
+		req3, err := ReadRequest(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("parse encoded %+v: %v", *req, err)
+		}
+		if req3.Cmd != req.Cmd || req3.Port != req.Port || !sameHost(req3.Host, req.Host) {
+			t.Fatalf("round trip %+v -> %+v", *req, *req3)
+		}
+	})
+}
+
+// FuzzHandshake run greeting, username/password and request on one stream
+func FuzzHandshake(f *testing.F) {
+	f.Add([]byte{5, 1, 2, 1, 1, 'u', 1, 'p', 5, 1, 0, 1, 127, 0, 0, 1, 0, 22}, []byte{1})
+	f.Add([]byte{5, 0, 1, 0, 0, 5, 1, 0, 3, 1, 'a', 0, 1}, []byte{})
+	f.Add([]byte{5, 255}, []byte{4})
+
+	f.Fuzz(func(t *testing.T, data []byte, sizes []byte) {
+		r := &chunkReader{data: data, sizes: sizes}
+		methods, err := ReadGreeting(r)
+		if err != nil {
+			return
+		}
+		if len(methods) != int(data[1]) {
+			t.Fatalf("got %v methods, NMETHODS %v", len(methods), data[1])
+		}
+		user, pass, err := ReadUserPass(r)
+		if err != nil {
+			return
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			t.Fatalf("user %v bytes, password %v bytes", len(user), len(pass))
+		}
+		ReadRequest(r)
+	})
+}
+
+// FuzzParseUDP check no panic and a parsed datagram encode back
+func FuzzParseUDP(f *testing.F) {
+	f.Add(AppendUDPHeader(nil, net.ParseIP("1.2.3.4"), 53))
+	f.Add(append(AppendUDPHeader(nil, net.ParseIP("::1"), 443), "quic"...))
+	f.Add([]byte{0, 0, 0, 3, 3, 'a', '.', 'b', 0, 53, 'q'})
+	f.Add([]byte{0, 0, 0, 3, 0, 0, 53})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		host, port, data, err := ParseUDP(b)
+		if err != nil {
+			return
+		}
+		if port < 0 || port > 0xffff {
+			t.Fatalf("port %v", port)
+		}
+		buf, err := AppendAddr([]byte{0, 0, 0}, host, port)
+		if err != nil {
+			t.Fatalf("encode %v:%v: %v", host, port, err)
+		}
+		host2, port2, data2, err := ParseUDP(append(buf, data...))
+		if err != nil || port2 != port || !sameHost(host2, host) || !bytes.Equal(data2, data) {
+			t.Fatalf("round trip %v:%v %q -> %v:%v %q %v", host, port, data, host2, port2, data2, err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package users
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt by Ulrich Drepper, https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	roundsPrefix  = "rounds="
+	roundsDefault = 5000
+	roundsMin     = 1000
+	roundsMax     = 999999999
+	saltMax       = 16
+
+	b64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var ErrFormat = errors.New("users: unsupported hash, want $5$ or $6$")
+
+// byte order of the final encoding, 3 bytes per group
+var (
+	order256 = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	order512 = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// Crypt hash pass with the algorithm, rounds and salt from setting (a full hash is fine)
+func Crypt(pass string, setting string) (string, error) {
+	var newHash func() hash.Hash
+	var order [][3]int
+	magic := setting
+	if len(magic) > 3 {
+		magic = magic[:3]
+	}
+	switch magic {
+	case "$5$":
+		newHash, order = sha256.New, order256
+	case "$6$":
+		newHash, order = sha512.New, order512
+	default:
+		return "", ErrFormat
+	}
+
+	rest := setting[3:]
+	rounds, custom := roundsDefault, false
+	if strings.HasPrefix(rest, roundsPrefix) {
+		idx := strings.IndexByte(rest, '$')
+		if idx < 0 {
+			return "", ErrFormat
+		}
+		n, err := strconv.ParseUint(rest[len(roundsPrefix):idx], 10, 32)
+		if err != nil {
+			return "", ErrFormat
+		}
+		rounds, custom = int(n), true
+		if rounds < roundsMin {
+			rounds = roundsMin
+		}
+		if rounds > roundsMax {
+			rounds = roundsMax
+		}
+		rest = rest[idx+1:]
+	}
+	salt := rest
+	if idx := strings.IndexByte(salt, '$'); idx >= 0 {
+		salt = salt[:idx]
+	}
+	if len(salt) > saltMax {
+		salt = salt[:saltMax]
+	}
+
+	sum := shaCrypt(newHash, []byte(pass), []byte(salt), rounds)
+
+	var sb strings.Builder
+	sb.WriteString(magic)
+	if custom {
+		sb.WriteString(roundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	for _, g := range order {
+		encode(&sb, uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	if len(sum) == sha512.Size {
+		encode(&sb, uint(sum[63]), 2)
+	} else {
+		encode(&sb, uint(sum[31])<<8|uint(sum[30]), 3)
+	}
+	return sb.String(), nil
+}
+
+func shaCrypt(newHash func() hash.Hash, pass []byte, salt []byte, rounds int) []byte {
+	h := newHash()
+	size := h.Size()
+
+	h.Write(pass)
+	h.Write(salt)
+	h.Write(pass)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(pass)
+	h.Write(salt)
+	h.Write(repeat(b, len(pass)))
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pass)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(pass); i++ {
+		h.Write(pass)
+	}
+	p := repeat(h.Sum(nil), len(pass))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeat(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+	return c[:size]
+}
+
+// repeat b to n bytes
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b...)
+	}
+	return out[:n]
+}
+
+func encode(sb *strings.Builder, v uint, n int) {
+	for ; n > 0; n-- {
+		sb.WriteByte(b64[v&0x3f])
+		v >>= 6
+	}
+}
@@ -0,0 +1,112 @@
+package users
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const longText = "a very much longer text to encrypt.  This one even stretches over morethan one line."
+
+// test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+var cryptTests = []struct {
+	setting string
+	pass    string
+	want    string
+}{
+	{"$5$saltstring", "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+	{"$5$rounds=10000$saltstringsaltstring", "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+	{"$5$rounds=5000$toolongsaltstring", "This is just a test", "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+	{"$5$rounds=1400$anotherlongsaltstring", longText, "$5$rounds=1400$anotherlongsalts$Rx.j8H.h8HjEDGomFU8bDkXm3XIUnzyxf12oP84Bnq1"},
+	{"$5$rounds=77777$short", "we have a short salt string but not a short password", "$5$rounds=77777$short$JiO1O3ZpDAxGJeaDIuqCoEFysAe1mZNJRs3pw0KQRd/"},
+	{"$5$rounds=123456$asaltof16chars..", "a short string", "$5$rounds=123456$asaltof16chars..$gP3VQ/6X7UUEW3HkBn2w1/Ptq2jxPyzV/cZKmF/wJvD"},
+	{"$5$rounds=10$roundstoolow", "the minimum number is still observed", "$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC"},
+
+	{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"$6$rounds=10000$saltstringsaltstring", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"$6$rounds=5000$toolongsaltstring", "This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"$6$rounds=1400$anotherlongsaltstring", longText, "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+	{"$6$rounds=77777$short", "we have a short salt string but not a short password", "$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	{"$6$rounds=123456$asaltof16chars..", "a short string", "$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+	{"$6$rounds=10$roundstoolow", "the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+}
+
+func TestCrypt(t *testing.T) {
+	for _, tt := range cryptTests {
+		got, err := Crypt(tt.pass, tt.setting)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.setting, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.setting, got, tt.want)
+		}
+
+		// full hash as setting give the same hash
+		if again, _ := Crypt(tt.pass, tt.want); again != tt.want {
+			t.Errorf("%v: again got %v", tt.setting, again)
+		}
+	}
+}
+
+func TestCryptFormat(t *testing.T) {
+	bad := []string{
+		"",
+		"$1$saltstring$xxx", // MD5
+		"$2y$10$xxx",        // bcrypt
+		"$5",
+		"$5$rounds=10000",
+		"$5$rounds=x$salt",
+		"$6$rounds=-1$salt",
+		"plain",
+	}
+	for _, s := range bad {
+		if _, err := Crypt("pass", s); err != ErrFormat {
+			t.Errorf("%q: err = %v, want %v", s, err, ErrFormat)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "users.txt")
+	// made by `openssl passwd -6 -salt abcdefgh secret`
+	data := "# comment\n\nalice:$6$abcdefgh$ltjgWl6579NluT/Vi1nwEvcil.G5Nbc4NiXZaNGStk8PSwGfQv72N2CKPPrVACtLtip/cZ/1GM/O6IND4WQhG.\n" +
+		"bob:" + cryptTests[0].want + "\n"
+	if err := os.WriteFile(fp, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Load(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Len() != 2 || !db.Has("alice") || db.Has("carol") {
+		t.Fatalf("loaded %v users", db.Len())
+	}
+
+	tests := []struct {
+		name, pass string
+		want       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"alice", "", false},
+		{"bob", "Hello world!", true},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"carol", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := db.Check(tt.name, tt.pass); got != tt.want {
+			t.Errorf("%v / %q: got %v, want %v", tt.name, tt.pass, got, tt.want)
+		}
+	}
+
+	// bad line, old users kept
+	os.WriteFile(fp, []byte("carol:$1$salt$hash\n"), 0600)
+	if err := db.Reload(); err == nil {
+		t.Fatal("reload bad file: no error")
+	}
+	if !db.Check("alice", "secret") || db.Has("carol") {
+		t.Errorf("old users not kept after bad reload")
+	}
+}
@@ -0,0 +1,100 @@
+// Package users is the password file for proxy authentication.
+//
+// One user per line as "name:hash", '#' start a comment,
+// hash is SHA-crypt ($5$ SHA-256 or $6$ SHA-512), made by `openssl passwd -6` or `mkpasswd -m sha-512`.
+package users
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// dummy hash to check unknown user, so response time not tell the user exist or not
+const dummyHash = "$6$8hJ3kQz1$dvjMmJJvjNavaO79XncHlgxG6ZFDLFnl3jhHANb4D2ENh1yKBt0PwtPvXuJem3F1dypnVSdXojFZBbnAEXHQ7."
+
+// DB is a loaded password file, safe for concurrent use
+type DB struct {
+	File string
+
+	lock  sync.RWMutex
+	users map[string]string
+}
+
+// Load read the password file
+func Load(fp string) (*DB, error) {
+	db := &DB{File: fp}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload read the file again, keep the old users on error
+func (db *DB) Reload() error {
+	f, err := os.Open(db.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for i := 1; sc.Scan(); i++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return fmt.Errorf("%v:%v: want name:hash", db.File, i)
+		}
+		name, hash := line[:idx], line[idx+1:]
+		if _, err := Crypt("", hash); err != nil {
+			return fmt.Errorf("%v:%v: %v", db.File, i, err)
+		}
+		users[name] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	db.users = users
+	db.lock.Unlock()
+	return nil
+}
+
+// Len return count of users
+func (db *DB) Len() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return len(db.users)
+}
+
+// Check return true if the user exist and the password match
+func (db *DB) Check(name string, pass string) bool {
+	db.lock.RLock()
+	hash, ok := db.users[name]
+	db.lock.RUnlock()
+	if !ok {
+		hash = dummyHash
+	}
+
+	out, err := Crypt(pass, hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(out), []byte(hash)) == 1 && ok
+}
+
+// Has return true if the user exist
+func (db *DB) Has(name string) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	_, ok := db.users[name]
+	return ok
+}
@@ -0,0 +1,198 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Dialer open WebSocket connections, optional through a HTTP proxy by CONNECT
+type Dialer struct {
+	Timeout   time.Duration // dial and handshake timeout each, 0 = no timeout
+	TLSConfig *tls.Config   // for wss://, nil = default
+
+	// Proxy return the proxy for the request, nil = direct.
+	// http.ProxyFromEnvironment use HTTPS_PROXY / HTTP_PROXY / NO_PROXY
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// NetDial open the TCP connection to server or proxy in ctx with Timeout, nil = net.DialTimeout by Timeout
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// IsURL check addr is ws:// or wss://
+func IsURL(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// HostPort return host:port of a ws:// or wss:// URL with default port
+func HostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func Dial(rawurl string) (*Conn, error) {
+	d := &Dialer{Proxy: http.ProxyFromEnvironment}
+	return d.Dial(rawurl)
+}
+
+func (d *Dialer) Dial(rawurl string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, errors.New("ws: unsupported scheme " + u.Scheme)
+	}
+	addr := HostPort(u)
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Host:   u.Host,
+		Header: make(http.Header),
+	}
+
+	var proxy *url.URL
+	if d.Proxy != nil {
+		// proxy func only know http and https
+		pu := *u
+		pu.Scheme = "http"
+		if u.Scheme == "wss" {
+			pu.Scheme = "https"
+		}
+		proxy, err = d.Proxy(&http.Request{URL: &pu})
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialAddr := addr
+	if proxy != nil {
+		if proxy.Scheme != "http" {
+			return nil, errors.New("ws: unsupported proxy scheme " + proxy.Scheme)
+		}
+		dialAddr = proxy.Host
+		if proxy.Port() == "" {
+			dialAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	if d.NetDial != nil {
+		ctx := context.Background()
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		conn, err = d.NetDial(ctx, "tcp", dialAddr)
+	} else {
+		conn, err = net.DialTimeout("tcp", dialAddr, d.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline time.Time
+	if d.Timeout > 0 {
+		deadline = time.Now().Add(d.Timeout)
+	}
+	conn.SetDeadline(deadline)
+	if proxy != nil {
+		if err := connect(conn, proxy, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if u.Scheme == "wss" {
+		cfg := d.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	c, err := handshake(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// connect ask the HTTP proxy for a tunnel to addr
+func connect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// the target send nothing before our request, so the reader can be dropped
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("ws: proxy CONNECT " + resp.Status)
+	}
+	return nil
+}
+
+func handshake(conn net.Conn, req *http.Request) (*Conn, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, ErrBadHandshake
+	}
+	return newConn(conn, br, true), nil
+}
@@ -0,0 +1,133 @@
+package ws
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func headerHas(h http.Header, name string, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade finish the server handshake and take over the connection
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("ws: connection not support hijack")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// http.Server may set deadline for the request
+	conn.SetDeadline(time.Time{})
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Listener accept WebSocket upgrade at Path on a HTTP server,
+// other requests get 404, so it look like a normal web server.
+type Listener struct {
+	ln   net.Listener
+	Path string // empty = any path
+
+	srv *http.Server
+
+	conns   chan net.Conn
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error
+}
+
+// NewListener serve HTTP on ln, ln can be a TLS listener for wss
+func NewListener(ln net.Listener, path string) *Listener {
+	l := &Listener{
+		ln:    ln,
+		Path:  path,
+		conns: make(chan net.Conn, 128),
+		die:   make(chan struct{}),
+	}
+	l.srv = &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := l.srv.Serve(ln)
+		l.closeWith(err)
+	}()
+	return l
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.Path != "" && r.URL.Path != l.Path {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.die:
+		conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.die:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) closeWith(err error) {
+	l.dieOnce.Do(func() {
+		l.err = err
+		close(l.die)
+	})
+}
+
+func (l *Listener) Close() error {
+	l.closeWith(net.ErrClosed)
+	return l.srv.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
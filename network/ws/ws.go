@@ -0,0 +1,303 @@
+// Package ws carry a byte stream over WebSocket (RFC 6455), for networks only allow HTTP(S).
+//
+// Data is sent as binary frames and any data frame is read as stream bytes,
+// same as websocat in binary mode, so both can talk to each other.
+// Close frame work as half-close: CloseWrite send it, the peer read EOF
+// and can still send data until it close too.
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const guid = "258EAFA5-E914-47DA-95CA-C5AB0DC11B65"
+
+// opcode
+const (
+	opContinue = 0x0
+	opText     = 0x1
+	opBinary   = 0x2
+	opClose    = 0x8
+	opPing     = 0x9
+	opPong     = 0xA
+)
+
+const (
+	maxControl = 125
+	maxFrame   = 32 * 1024 // payload per written frame
+
+	closeNormal  = 1000
+	closeTimeout = time.Second
+)
+
+var (
+	ErrProtocol     = errors.New("ws: protocol error")
+	ErrBadHandshake = errors.New("ws: bad handshake")
+)
+
+// acceptKey compute Sec-WebSocket-Accept from Sec-WebSocket-Key
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(guid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func newKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+// Conn is a WebSocket connection as a byte stream, implement net.Conn
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader // may hold data read during handshake
+	client bool          // client mask the frames it send
+
+	rlock   sync.Mutex
+	remain  int64 // payload left in current data frame
+	mask    [4]byte
+	masked  bool
+	maskPos int
+	rEOF    bool
+
+	wlock chan struct{} // 1 slot as mutex, so Close can try it
+	wEOF  bool          // close frame sent
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{Conn: conn, br: br, client: client, wlock: make(chan struct{}, 1)}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	for c.remain == 0 {
+		if c.rEOF {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remain -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame read frame header, handle control frames, caller hold rlock
+func (c *Conn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		if err == io.EOF {
+			// closed without close frame
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	op := hdr[0] & 0x0f
+	if hdr[0]&0x70 != 0 {
+		return ErrProtocol // no extension negotiated
+	}
+	masked := hdr[1]&0x80 != 0
+	if masked == c.client {
+		// client must mask, server must not
+		return ErrProtocol
+	}
+
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var l [2]byte
+		if _, err := io.ReadFull(c.br, l[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(l[:]))
+	case 127:
+		var l [8]byte
+		if _, err := io.ReadFull(c.br, l[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(l[:]))
+		if length < 0 {
+			return ErrProtocol
+		}
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opContinue, opText, opBinary:
+		c.remain = length
+		c.mask = mask
+		c.masked = masked
+		c.maskPos = 0
+		return nil
+	}
+
+	// control frame
+	if length > maxControl || hdr[0]&0x80 == 0 {
+		return ErrProtocol
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	switch op {
+	case opPing:
+		return c.writeControl(opPong, payload)
+	case opPong:
+	case opClose:
+		c.rEOF = true
+	default:
+		return ErrProtocol
+	}
+	return nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wlock <- struct{}{}
+	defer func() { <-c.wlock }()
+	if c.wEOF {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxFrame {
+			n = maxFrame
+		}
+		if err := c.writeFrame(opBinary, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *Conn) writeControl(op byte, payload []byte) error {
+	c.wlock <- struct{}{}
+	defer func() { <-c.wlock }()
+	if c.wEOF {
+		return nil
+	}
+	if op == opClose {
+		c.wEOF = true
+	}
+	return c.writeFrame(op, payload)
+}
+
+// caller hold wlock
+func (c *Conn) writeFrame(op byte, p []byte) error {
+	buf := make([]byte, 0, 14+len(p))
+	buf = append(buf, 0x80|op) // FIN
+
+	var mbit byte
+	if c.client {
+		mbit = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		buf = append(buf, mbit|byte(len(p)))
+	case len(p) <= 0xffff:
+		buf = append(buf, mbit|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(p)))
+		buf = append(buf, mbit|127)
+		buf = append(buf, l[:]...)
+	}
+
+	if !c.client {
+		buf = append(buf, p...)
+		_, err := c.Conn.Write(buf)
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+	off := len(buf)
+	buf = append(buf, p...)
+	for i := range p {
+		buf[off+i] ^= mask[i&3]
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// CloseWrite send close frame, no more data from this side
+func (c *Conn) CloseWrite() error {
+	var p [2]byte
+	binary.BigEndian.PutUint16(p[:], closeNormal)
+	return c.writeControl(opClose, p[:])
+}
+
+// Close send close frame if not sent and close the connection,
+// skip the close frame when a Write is blocked
+func (c *Conn) Close() error {
+	select {
+	case c.wlock <- struct{}{}:
+		if !c.wEOF {
+			c.wEOF = true
+			var p [2]byte
+			binary.BigEndian.PutUint16(p[:], closeNormal)
+			c.SetWriteDeadline(time.Now().Add(closeTimeout))
+			c.writeFrame(opClose, p[:])
+		}
+		<-c.wlock
+	default:
+	}
+	return c.Conn.Close()
+}
+
+// Unwrap return the underlying connection
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
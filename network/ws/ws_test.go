@@ -0,0 +1,300 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// frame build a client frame by hand, masked unless mask is nil
+func frame(fin bool, op byte, payload []byte, mask []byte) []byte {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	b := []byte{b0}
+	var mbit byte
+	if mask != nil {
+		mbit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, mbit|byte(len(payload)))
+	default:
+		b = append(b, mbit|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if mask == nil {
+		return append(b, payload...)
+	}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i&3])
+	}
+	return b
+}
+
+var testMask = []byte{1, 2, 3, 4}
+
+// rawServer return a server side Conn and the raw client side,
+// everything the server write is collected in the returned channel
+func rawServer(t *testing.T) (*Conn, net.Conn, chan []byte) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	out := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := c1.Read(buf)
+			if err != nil {
+				close(out)
+				return
+			}
+			out <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	return newConn(c2, nil, false), c1, out
+}
+
+func echoServer(t *testing.T, path string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln, path)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.(*Conn).CloseWrite()
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	addr := echoServer(t, "/ws")
+	c, err := Dial("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// small, 16 bit and 64 bit length, more than one frame
+	var data []byte
+	for _, n := range []int{5, 300, 70000, 3 * maxFrame} {
+		data = append(data, bytes.Repeat([]byte{byte(n)}, n)...)
+	}
+	go func() {
+		c.Write(data)
+		c.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(c)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %v bytes, err %v", len(got), err)
+	}
+	if _, err := c.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after CloseWrite err = %v", err)
+	}
+
+	// not the path, look like a normal web server
+	if _, err := Dial("ws://" + addr + "/other"); err != ErrBadHandshake {
+		t.Fatalf("dial other path err = %v", err)
+	}
+	resp, err := http.Get("http://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET status %v", resp.Status)
+	}
+}
+
+func TestFragmented(t *testing.T) {
+	srv, raw, out := rawServer(t)
+
+	go func() {
+		raw.Write(frame(false, opText, []byte("hel"), testMask))
+		raw.Write(frame(true, opPing, []byte("ping"), testMask)) // between fragments
+		raw.Write(frame(false, opContinue, nil, testMask))
+		raw.Write(frame(true, opContinue, []byte("lo"), testMask))
+		raw.Write(frame(true, opPong, nil, testMask)) // ignored
+		raw.Write(frame(true, opClose, []byte{0x03, 0xe8}, testMask))
+	}()
+	got, err := ioutil.ReadAll(srv)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q %v", got, err)
+	}
+
+	// pong with the ping payload, not masked by server
+	select {
+	case b := <-out:
+		if want := frame(true, opPong, []byte("ping"), nil); !bytes.Equal(b, want) {
+			t.Fatalf("got %x, want pong %x", b, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no pong")
+	}
+
+	// still can send after peer close
+	go srv.Write([]byte("bye"))
+	if b := <-out; !bytes.Equal(b, frame(true, opBinary, []byte("bye"), nil)) {
+		t.Fatalf("got %x after peer close", b)
+	}
+}
+
+func TestBadFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"not masked", frame(true, opBinary, []byte("x"), nil)},
+		{"reserved bit", append([]byte{0xc2}, frame(true, opBinary, []byte("x"), testMask)[1:]...)},
+		{"fragmented ping", frame(false, opPing, nil, testMask)},
+		{"long ping", frame(true, opPing, make([]byte, maxControl+1), testMask)},
+		{"unknown opcode", frame(true, 0xb, nil, testMask)},
+	}
+	for _, tt := range tests {
+		srv, raw, _ := rawServer(t)
+		go raw.Write(tt.in)
+		if _, err := srv.Read(make([]byte, 16)); err != ErrProtocol {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, ErrProtocol)
+		}
+	}
+
+	// closed without close frame
+	srv, raw, _ := rawServer(t)
+	go func() {
+		raw.Write(frame(true, opBinary, []byte("x"), testMask))
+		raw.Close()
+	}()
+	if got, err := ioutil.ReadAll(srv); err != io.ErrUnexpectedEOF || string(got) != "x" {
+		t.Errorf("read %q, err = %v, want %v", got, err, io.ErrUnexpectedEOF)
+	}
+}
+
+// fakeServer answer the handshake by resp, %s is the right Sec-WebSocket-Accept
+func fakeServer(t *testing.T, resp func(accept string) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(c))
+			if err == nil {
+				io.WriteString(c, resp(acceptKey(req.Header.Get("Sec-WebSocket-Key"))))
+			}
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestBadHandshake(t *testing.T) {
+	tests := []struct {
+		name string
+		resp func(accept string) string
+	}{
+		{"bad accept", func(string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey("other") + "\r\n\r\n"
+		}},
+		{"no accept", func(string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+		}},
+		{"no upgrade", func(accept string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+		}},
+		{"status 200", func(accept string) string {
+			return "HTTP/1.1 200 OK\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+		}},
+	}
+	for _, tt := range tests {
+		addr := fakeServer(t, tt.resp)
+		if _, err := Dial("ws://" + addr + "/"); err != ErrBadHandshake {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, ErrBadHandshake)
+		}
+	}
+
+	// the right one pass
+	addr := fakeServer(t, func(accept string) string {
+		return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	})
+	c, err := Dial("ws://" + addr + "/")
+	if err != nil {
+		t.Fatalf("good accept: %v", err)
+	}
+	c.Close()
+}
+
+func TestDialTimeout(t *testing.T) {
+	d := &Dialer{
+		Timeout: 100 * time.Millisecond,
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("ws://192.0.2.1/")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout not passed to NetDial")
+	}
+}
+
+func TestCloseBlockedWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := newConn(c1, nil, true)
+
+	// nobody read, Write block
+	werr := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("stuck"))
+		werr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by Write")
+	}
+	if err := <-werr; err == nil {
+		t.Fatal("blocked Write success after Close")
+	}
+}